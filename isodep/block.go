@@ -0,0 +1,256 @@
+// Package isodep implements the ISO/IEC 14443-4 half-duplex block transmission protocol (ISO-DEP, T=CL) independent of
+// the transport used to move frames. Frames are handled without the CRC which is expected to be added and checked by
+// the transport.
+package isodep
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	pcbTypeMask = 0xC0
+	pcbIBlock   = 0x00
+	pcbRBlock   = 0x80
+	pcbSBlock   = 0xC0
+
+	pcbBlockNumber = 0x01
+	pcbNAD         = 0x04
+	pcbCID         = 0x08
+	pcbChaining    = 0x10 // I-Block
+	pcbNAK         = 0x10 // R-Block
+	pcbSTypeMask   = 0x30 // S-Block
+
+	pcbIFixedMask = 0xE2
+	pcbIFixed     = 0x02
+	pcbRFixedMask = 0xE6
+	pcbRFixed     = 0xA2
+	pcbSFixedMask = 0xC7
+	pcbSFixed     = 0xC2
+
+	sDeselect = 0x00
+	sWTX      = 0x30
+
+	ratsStart = 0xE0
+
+	nadRFU = 0x88
+)
+
+var (
+	ErrEmptyFrame     = errors.New("empty frame")
+	ErrBadPCB         = errors.New("bad PCB")
+	ErrTruncatedFrame = errors.New("truncated frame")
+)
+
+// BlockType is the type of block as indicated by the PCB
+type BlockType int
+
+const (
+	BlockI BlockType = iota
+	BlockR
+	BlockS
+)
+
+func (t BlockType) String() string {
+	switch t {
+	case BlockI:
+		return "I"
+	case BlockR:
+		return "R"
+	case BlockS:
+		return "S"
+	default:
+		return fmt.Sprintf("BlockType(%d)", int(t))
+	}
+}
+
+// Block is a decoded ISO/IEC 14443-4 block
+type Block struct {
+	Type        BlockType
+	BlockNumber byte
+
+	HasCID bool
+	CID    byte
+	HasNAD bool
+	NAD    byte
+
+	// Chaining is set on I-Blocks that are followed by another block of the same chain
+	Chaining bool
+	// NAK is set on R(NAK) blocks, R(ACK) otherwise
+	NAK bool
+	// WTX is set on S(WTX) blocks, S(DESELECT) otherwise
+	WTX bool
+
+	INF []byte
+
+	// UnexpectedBits is set if the PCB had fixed bits with the wrong value, these are otherwise ignored
+	UnexpectedBits bool
+}
+
+// SwapNAD swaps the source and destination node addresses of a NAD
+func SwapNAD(nad byte) byte {
+	return nad&0x07<<4 | nad>>4&0x07
+}
+
+// IsRATS returns true if the frame is a RATS command
+func IsRATS(frame []byte) bool {
+	return len(frame) == 2 && frame[0] == ratsStart
+}
+
+// ParseBlock decodes a frame into a Block. INF references the frame.
+func ParseBlock(frame []byte) (b Block, err error) {
+	if len(frame) == 0 {
+		err = ErrEmptyFrame
+		return
+	}
+
+	pcb := frame[0]
+	switch pcb & pcbTypeMask {
+	case pcbIBlock:
+		b.Type = BlockI
+		b.Chaining = pcb&pcbChaining != 0
+		b.UnexpectedBits = pcb&pcbIFixedMask != pcbIFixed
+	case pcbRBlock:
+		b.Type = BlockR
+		b.NAK = pcb&pcbNAK != 0
+		b.UnexpectedBits = pcb&pcbRFixedMask != pcbRFixed
+	case pcbSBlock:
+		b.Type = BlockS
+		switch pcb & pcbSTypeMask {
+		case sDeselect:
+		case sWTX:
+			b.WTX = true
+		default:
+			err = fmt.Errorf("%w: RFU S-Block %02X", ErrBadPCB, pcb)
+			return
+		}
+		b.UnexpectedBits = pcb&pcbSFixedMask != pcbSFixed
+	default:
+		err = fmt.Errorf("%w: %02X", ErrBadPCB, pcb)
+		return
+	}
+
+	b.BlockNumber = pcb & pcbBlockNumber
+	b.HasCID = pcb&pcbCID != 0
+	// NAD is only defined for I-Blocks, the bit is RFU for other block types
+	b.HasNAD = b.Type == BlockI && pcb&pcbNAD != 0
+
+	rest := frame[1:]
+	if b.HasCID {
+		if len(rest) < 1 {
+			err = ErrTruncatedFrame
+			return
+		}
+		b.CID = rest[0] & 0x0F
+		rest = rest[1:]
+	}
+	if b.HasNAD {
+		if len(rest) < 1 {
+			err = ErrTruncatedFrame
+			return
+		}
+		b.NAD = rest[0]
+		rest = rest[1:]
+	}
+
+	b.INF = rest
+	return
+}
+
+// PCB encodes the protocol control byte for the block
+func (b Block) PCB() byte {
+	var pcb byte
+	switch b.Type {
+	case BlockI:
+		pcb = pcbIFixed
+		if b.Chaining {
+			pcb |= pcbChaining
+		}
+		if b.HasNAD {
+			pcb |= pcbNAD
+		}
+	case BlockR:
+		pcb = pcbRFixed
+		if b.NAK {
+			pcb |= pcbNAK
+		}
+	case BlockS:
+		pcb = pcbSFixed
+		if b.WTX {
+			pcb |= sWTX
+		}
+	}
+
+	if b.HasCID {
+		pcb |= pcbCID
+	}
+	if b.Type != BlockS {
+		pcb |= b.BlockNumber & pcbBlockNumber
+	}
+
+	return pcb
+}
+
+// HeaderLen returns the length of the PCB, CID and NAD bytes
+func (b Block) HeaderLen() int {
+	n := 1
+	if b.HasCID {
+		n++
+	}
+	if b.HasNAD {
+		n++
+	}
+	return n
+}
+
+// Bytes encodes the block into a frame
+func (b Block) Bytes() []byte {
+	out := make([]byte, 0, b.HeaderLen()+len(b.INF))
+	out = append(out, b.PCB())
+	if b.HasCID {
+		out = append(out, b.CID&0x0F)
+	}
+	if b.HasNAD {
+		out = append(out, b.NAD)
+	}
+	return append(out, b.INF...)
+}
+
+func (b Block) String() string {
+	var sb strings.Builder
+
+	switch b.Type {
+	case BlockI:
+		_, _ = fmt.Fprintf(&sb, "I(%d)", b.BlockNumber)
+		if b.Chaining {
+			sb.WriteString(" chaining")
+		}
+	case BlockR:
+		if b.NAK {
+			_, _ = fmt.Fprintf(&sb, "R(NAK,%d)", b.BlockNumber)
+		} else {
+			_, _ = fmt.Fprintf(&sb, "R(ACK,%d)", b.BlockNumber)
+		}
+	case BlockS:
+		if b.WTX {
+			sb.WriteString("S(WTX)")
+		} else {
+			sb.WriteString("S(DESELECT)")
+		}
+	default:
+		sb.WriteString(b.Type.String())
+	}
+
+	if b.HasCID {
+		_, _ = fmt.Fprintf(&sb, " CID=%d", b.CID)
+	}
+	if b.HasNAD {
+		_, _ = fmt.Fprintf(&sb, " NAD=%02X", b.NAD)
+	}
+	if len(b.INF) > 0 {
+		_, _ = fmt.Fprintf(&sb, " INF=%X", b.INF)
+	}
+
+	return sb.String()
+}
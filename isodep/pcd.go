@@ -0,0 +1,433 @@
+package isodep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-apdu"
+	"github.com/nvx/go-rfid"
+	"github.com/nvx/go-rfid/type4"
+	"log/slog"
+	"time"
+)
+
+const (
+	// fc is the carrier frequency in Hz
+	fc = 13_560_000
+
+	// fwtDelta is the additional frame waiting time tolerance (ΔFWT) of 49152/fc
+	fwtDelta = 49152 * time.Second / fc
+
+	ppsStart = 0xD0
+	pps0PPS1 = 0x11
+
+	// DefaultFSDI indicates the PCD is able to receive 256 byte frames
+	DefaultFSDI = 8
+	// DefaultMaxRetries is the number of times a block is retried before giving up
+	DefaultMaxRetries = 2
+)
+
+var (
+	ErrNotActive    = errors.New("PICC not activated")
+	ErrProtocol     = errors.New("ISO 14443-4 protocol error")
+	ErrTransmission = errors.New("ISO 14443-4 transmission error")
+	ErrPPS          = errors.New("unsupported PPS bit rate")
+)
+
+var _ rfid.ExchangerAPDUer = (*PCD)(nil)
+
+// Transceiver sends a raw frame to a PICC and waits up to timeout for the response frame. CRC is added and checked by
+// the Transceiver. Any error other than context cancellation is treated as a transmission error and recovered from.
+type Transceiver interface {
+	Transceive(ctx context.Context, frame []byte, timeout time.Duration) ([]byte, error)
+}
+
+// TransceiverFunc implements the Transceiver interface as a Transceiver.Transceive func
+type TransceiverFunc func(ctx context.Context, frame []byte, timeout time.Duration) ([]byte, error)
+
+func (f TransceiverFunc) Transceive(ctx context.Context, frame []byte, timeout time.Duration) ([]byte, error) {
+	return f(ctx, frame, timeout)
+}
+
+// BitRateSetter is optionally implemented by a Transceiver able to change bit rate after a successful PPS
+type BitRateSetter interface {
+	SetBitRate(ctx context.Context, dsi, dri byte) error
+}
+
+// PCDOptions configures a PCD, the zero value is usable
+type PCDOptions struct {
+	// FSDI sent in RATS, DefaultFSDI if zero
+	FSDI byte
+	// CID is used if UseCID is set and the PICC supports CID
+	UseCID bool
+	CID    byte
+	// NAD is sent in the first block of each command if UseNAD is set and the PICC supports NAD
+	UseNAD bool
+	NAD    byte
+	// DSI and DRI request a bit rate change with PPS after RATS if either is non-zero
+	DSI, DRI byte
+	// MaxRetries is the number of times a block is retried on transmission errors, DefaultMaxRetries if zero
+	MaxRetries int
+	// TimeoutMargin is added to the FWT to allow for transport latency
+	TimeoutMargin time.Duration
+}
+
+// PCD implements the reader side of ISO/IEC 14443-4 on top of a raw frame Transceiver.
+// A PCD is not safe for concurrent use.
+type PCD struct {
+	t    Transceiver
+	opts PCDOptions
+
+	active      bool
+	ats         type4.ATS
+	fsc         int
+	fwt         time.Duration
+	useCID      bool
+	useNAD      bool
+	blockNumber byte
+}
+
+// NewPCD returns a PCD, Activate or SetATS must be called before exchanging APDUs
+func NewPCD(t Transceiver, opts PCDOptions) *PCD {
+	if opts.FSDI == 0 {
+		opts.FSDI = DefaultFSDI
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DefaultMaxRetries
+	}
+
+	return &PCD{
+		t:    t,
+		opts: opts,
+	}
+}
+
+// FWT returns the frame waiting time for the given FWI
+func FWT(fwi byte) time.Duration {
+	if fwi > 14 {
+		// FWI 15 is RFU and treated as the default
+		fwi = type4.DefaultFWI
+	}
+	return time.Duration(4096<<fwi) * time.Second / fc
+}
+
+// Activate sends RATS and optionally PPS to a selected PICC and returns the ATS
+func (p *PCD) Activate(ctx context.Context) (_ type4.ATS, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	p.active = false
+
+	param := p.opts.FSDI<<4 | p.cid()
+	// RATS is answered within the default FWT
+	resp, err := p.t.Transceive(ctx, []byte{ratsStart, param}, FWT(type4.DefaultFWI)+fwtDelta+p.opts.TimeoutMargin)
+	if err != nil {
+		err = fmt.Errorf("error sending RATS: %w", err)
+		return
+	}
+
+	ats, err := type4.ParseATS(resp)
+	if err != nil {
+		return
+	}
+
+	p.SetATS(ats)
+
+	err = sleep(ctx, sfgt(ats.SFGI))
+	if err != nil {
+		return
+	}
+
+	if p.opts.DSI != 0 || p.opts.DRI != 0 {
+		err = p.pps(ctx)
+		if err != nil {
+			p.active = false
+			return
+		}
+	}
+
+	return ats, nil
+}
+
+// cid returns the CID assigned to the PICC with RATS, 0 unless UseCID is set
+func (p *PCD) cid() byte {
+	if !p.opts.UseCID {
+		return 0
+	}
+	return p.opts.CID & 0x0F
+}
+
+// SetATS activates the PCD with an ATS received by other means, for example when the transport performs RATS itself
+func (p *PCD) SetATS(ats type4.ATS) {
+	p.ats = ats
+	p.fsc = ats.FSC()
+	p.fwt = FWT(ats.FWI)
+	p.useCID = p.opts.UseCID && ats.CIDSupported
+	p.useNAD = p.opts.UseNAD && ats.NADSupported
+	// Rule A. The PCD block number shall be initialised to 0 for each activated PICC.
+	p.blockNumber = 0
+	p.active = true
+}
+
+// ATS returns the ATS of the activated PICC
+func (p *PCD) ATS() type4.ATS {
+	return p.ats
+}
+
+func (p *PCD) pps(ctx context.Context) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	dsi, dri := p.opts.DSI&0x03, p.opts.DRI&0x03
+	if !p.ats.HasTA ||
+		(dsi != 0 && p.ats.DS&(1<<(dsi-1)) == 0) ||
+		(dri != 0 && p.ats.DR&(1<<(dri-1)) == 0) ||
+		(p.ats.SameBitRate && dsi != dri) {
+		err = fmt.Errorf("%w: DSI %d, DRI %d", ErrPPS, dsi, dri)
+		return
+	}
+
+	start := byte(ppsStart) | p.cid()
+	resp, err := p.t.Transceive(ctx, []byte{start, pps0PPS1, dsi<<2 | dri}, p.timeout(1))
+	if err != nil {
+		err = fmt.Errorf("error sending PPS: %w", err)
+		return
+	}
+	if len(resp) != 1 || resp[0] != start {
+		err = fmt.Errorf("%w: bad PPS response %X", ErrProtocol, resp)
+		return
+	}
+
+	if setter, ok := p.t.(BitRateSetter); ok {
+		err = setter.SetBitRate(ctx, dsi, dri)
+		if err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+// Exchange sends a command APDU and returns the response APDU, chaining in both directions as required
+func (p *PCD) Exchange(ctx context.Context, capdu []byte) (_ []byte, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	if !p.active {
+		err = ErrNotActive
+		return
+	}
+
+	var resp Block
+	first := true
+	for first || len(capdu) > 0 {
+		block := Block{
+			Type:        BlockI,
+			BlockNumber: p.blockNumber,
+			HasCID:      p.useCID,
+			CID:         p.opts.CID,
+			// NAD is only sent in the first block of a chain
+			HasNAD: p.useNAD && first,
+			NAD:    p.opts.NAD,
+		}
+		first = false
+
+		// FSC includes the 2 byte CRC
+		maxINF := p.fsc - 2 - block.HeaderLen()
+		n := min(maxINF, len(capdu))
+		block.INF = capdu[:n]
+		capdu = capdu[n:]
+		block.Chaining = len(capdu) > 0
+
+		frame := block.Bytes()
+		resp, err = p.transceiveBlock(ctx, frame, frame, p.rBlock(true))
+		if err != nil {
+			return
+		}
+
+		if block.Chaining {
+			// Rule 7. When an R(ACK) block is received, if its block number is equal to the PCD’s current block
+			// number, chaining shall be continued.
+			if resp.Type != BlockR || resp.NAK {
+				err = fmt.Errorf("%w: expected R(ACK) during chaining, got %s", ErrProtocol, resp)
+				return
+			}
+			// Rule B
+			p.blockNumber ^= 1
+		}
+	}
+
+	var rapdu []byte
+	for {
+		if resp.Type != BlockI || resp.BlockNumber != p.blockNumber {
+			err = fmt.Errorf("%w: expected I(%d), got %s", ErrProtocol, p.blockNumber, resp)
+			return
+		}
+		// Rule B. When an I-Block or an R(ACK) block with a block number equal to the current block number is
+		// received, the PCD shall toggle the current block number before optionally sending a block to the PICC.
+		p.blockNumber ^= 1
+		rapdu = append(rapdu, resp.INF...)
+
+		if !resp.Chaining {
+			return rapdu, nil
+		}
+
+		// Rule 2. When an I-block indicating chaining is received, the block shall be acknowledged by an R(ACK) block.
+		// Rule 5. When an invalid block is received or a FWT time-out occurs, during PICC chaining an R(ACK) is sent.
+		ack := p.rBlock(false)()
+		resp, err = p.transceiveBlock(ctx, ack.Bytes(), nil, p.rBlock(false))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// APDU implements rfid.APDUer
+func (p *PCD) APDU(ctx context.Context, capdu apdu.Capdu) (apdu.Rapdu, error) {
+	return rfid.ExchangerFunc(p.Exchange).APDU(ctx, capdu)
+}
+
+// Deselect sends S(DESELECT) to the PICC
+func (p *PCD) Deselect(ctx context.Context) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	if !p.active {
+		return nil
+	}
+	p.active = false
+
+	deselect := Block{Type: BlockS, HasCID: p.useCID, CID: p.opts.CID}
+	frame := deselect.Bytes()
+
+	// Rule 8. If the S(DESELECT) response is not error free, S(DESELECT) is retransmitted.
+	for tries := 0; ; tries++ {
+		var resp []byte
+		resp, err = p.t.Transceive(ctx, frame, p.timeout(1))
+		if err == nil {
+			var block Block
+			block, err = ParseBlock(resp)
+			if err == nil && (block.Type != BlockS || block.WTX) {
+				err = fmt.Errorf("%w: expected S(DESELECT), got %s", ErrProtocol, block)
+			}
+			if err == nil {
+				return nil
+			}
+		}
+		if ctx.Err() != nil || tries >= p.opts.MaxRetries {
+			return
+		}
+	}
+}
+
+// rBlock returns a func building the recovery block sent on transmission errors
+func (p *PCD) rBlock(nak bool) func() Block {
+	return func() Block {
+		return Block{
+			Type:        BlockR,
+			NAK:         nak,
+			BlockNumber: p.blockNumber,
+			HasCID:      p.useCID,
+			CID:         p.opts.CID,
+		}
+	}
+}
+
+func (p *PCD) timeout(wtxm int) time.Duration {
+	return p.fwt*time.Duration(wtxm) + fwtDelta + p.opts.TimeoutMargin
+}
+
+// transceiveBlock sends frame and returns the response block, answering S(WTX) requests and recovering from
+// transmission errors by sending the recovery block or retransmitting lastI as per ISO/IEC 14443-4 rules 4, 5 and 6
+func (p *PCD) transceiveBlock(ctx context.Context, frame []byte, lastI []byte, recovery func() Block) (_ Block, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	timeout := p.timeout(1)
+	tries := 0
+	retry := func(cause error) error {
+		tries++
+		if tries > p.opts.MaxRetries {
+			return fmt.Errorf("%w: %w", ErrTransmission, cause)
+		}
+		slog.DebugContext(ctx, "Retrying ISO 14443-4 block", rfid.ErrorAttrs(cause), slog.Int("try", tries))
+		return nil
+	}
+
+	for {
+		var resp []byte
+		resp, err = p.t.Transceive(ctx, frame, timeout)
+		timeout = p.timeout(1)
+
+		var block Block
+		if err == nil {
+			block, err = ParseBlock(resp)
+		}
+		if err == nil && p.useCID && (!block.HasCID || block.CID != p.opts.CID&0x0F) {
+			err = fmt.Errorf("%w: response for wrong CID", ErrProtocol)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				err = context.Cause(ctx)
+				return
+			}
+
+			err = retry(err)
+			if err != nil {
+				return
+			}
+			frame = recovery().Bytes()
+			continue
+		}
+
+		switch {
+		case block.Type == BlockS && block.WTX:
+			// Rule 3. S(WTX) requests are answered with S(WTX) responses containing the same WTXM
+			if len(block.INF) < 1 || block.INF[0]&0x3F == 0 || block.INF[0]&0x3F > 59 {
+				err = fmt.Errorf("%w: bad S(WTX) %s", ErrProtocol, block)
+				return
+			}
+			wtxm := block.INF[0] & 0x3F
+			slog.DebugContext(ctx, "Got S(WTX)", slog.Int("wtxm", int(wtxm)))
+			frame = Block{Type: BlockS, WTX: true, HasCID: p.useCID, CID: p.opts.CID, INF: []byte{wtxm}}.Bytes()
+			timeout = p.timeout(int(wtxm))
+			continue
+		case block.Type == BlockS:
+			err = fmt.Errorf("%w: unexpected %s", ErrProtocol, block)
+			return
+		case block.Type == BlockR && block.NAK:
+			err = fmt.Errorf("%w: PICC sent %s", ErrProtocol, block)
+			return
+		case block.Type == BlockR && block.BlockNumber != p.blockNumber && lastI != nil:
+			// Rule 6. When an R(ACK) block is received, if its block number is not equal to the PCD’s current block
+			// number, the last I-block shall be re-transmitted.
+			err = retry(fmt.Errorf("%w: PICC did not receive I-Block", ErrTransmission))
+			if err != nil {
+				return
+			}
+			frame = lastI
+			continue
+		}
+
+		return block, nil
+	}
+}
+
+// sfgt returns the start-up frame guard time for the given SFGI
+func sfgt(sfgi byte) time.Duration {
+	if sfgi == 0 || sfgi > 14 {
+		return 0
+	}
+	return time.Duration(4096<<sfgi) * time.Second / fc
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
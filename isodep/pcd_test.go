@@ -0,0 +1,121 @@
+package isodep
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// loopback connects a PCD to a PICC, dropping the frames at the given indexes in either direction
+func loopback(p *PICC, drop map[int]bool) Transceiver {
+	var n int
+	return TransceiverFunc(func(ctx context.Context, frame []byte, _ time.Duration) ([]byte, error) {
+		n++
+		if drop[n] {
+			return nil, errors.New("dropped command")
+		}
+
+		resp, err := p.Process(ctx, frame)
+		if err != nil {
+			return nil, err
+		}
+
+		n++
+		if drop[n] || resp == nil {
+			return nil, errors.New("dropped response")
+		}
+		return resp, nil
+	})
+}
+
+func TestPCD_Exchange(t *testing.T) {
+	t.Parallel()
+
+	// FSCI 0 and FSDI 1 limit frames to 16 and 24 bytes forcing chaining in both directions
+	picc := NewPICC(&echoHandler{}, PICCOptions{ATS: []byte{0x02, 0x00}})
+
+	pcd := NewPCD(loopback(picc, map[int]bool{
+		// I-Block lost
+		3: true,
+		// response to chained I-Block lost
+		8: true,
+		// R(ACK) during response chaining lost
+		19: true,
+		// chained response lost
+		23: true,
+	}), PCDOptions{FSDI: 1})
+
+	ats, err := pcd.Activate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 16, ats.FSC())
+
+	capdu := bytes.Repeat([]byte{0x01, 0x02, 0x03}, 20)
+	rapdu, err := pcd.Exchange(context.Background(), capdu)
+	require.NoError(t, err)
+	assert.Equal(t, append(capdu, 0x90, 0x00), rapdu)
+
+	rapdu, err = pcd.Exchange(context.Background(), []byte{0x00, 0xA4})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x00, 0xA4, 0x90, 0x00}, rapdu)
+
+	require.NoError(t, pcd.Deselect(context.Background()))
+	assert.False(t, picc.Active())
+}
+
+func TestPCD_Activate_cid(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		opts PCDOptions
+		rats []byte
+	}{
+		{"CID unused", PCDOptions{CID: 3}, []byte{0xE0, 0x80}},
+		{"CID used", PCDOptions{UseCID: true, CID: 3}, []byte{0xE0, 0x83}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var rats []byte
+			pcd := NewPCD(TransceiverFunc(func(_ context.Context, frame []byte, _ time.Duration) ([]byte, error) {
+				rats = bytes.Clone(frame)
+				return []byte{0x01}, nil
+			}), tt.opts)
+
+			_, err := pcd.Activate(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, tt.rats, rats)
+		})
+	}
+}
+
+func TestPCD_Exchange_wtx(t *testing.T) {
+	t.Parallel()
+
+	var wtxRequests int
+	picc := NewPICC(&slowHandler{delay: 50 * time.Millisecond}, PICCOptions{
+		ATS:      []byte{0x01},
+		WTXM:     2,
+		WTXAfter: 5 * time.Millisecond,
+	})
+	pcd := NewPCD(TransceiverFunc(func(ctx context.Context, frame []byte, timeout time.Duration) ([]byte, error) {
+		resp, err := picc.Process(ctx, frame)
+		if block, perr := ParseBlock(resp); perr == nil && block.WTX {
+			wtxRequests++
+		}
+		return resp, err
+	}), PCDOptions{})
+
+	_, err := pcd.Activate(context.Background())
+	require.NoError(t, err)
+
+	rapdu, err := pcd.Exchange(context.Background(), []byte{0x00, 0xA4})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x00, 0xA4, 0x90, 0x00}, rapdu)
+	assert.Positive(t, wtxRequests)
+	assert.False(t, picc.WTXUnsupported())
+}
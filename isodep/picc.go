@@ -0,0 +1,548 @@
+package isodep
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-rfid"
+	"github.com/nvx/go-rfid/type4"
+	"log/slog"
+	"time"
+)
+
+const (
+	// noCID is used as the CID while the PICC is not activated
+	noCID = 0xFF
+
+	// maxWTXM is the largest waiting time extension multiplier
+	maxWTXM = 59
+)
+
+// ErrWTXNotForwarded is reported when a WTX request was not answered with S(WTX), usually because the transport does
+// not forward S(WTX) responses from the PCD
+var ErrWTXNotForwarded = errors.New("S(WTX) response not received")
+
+// PICCOptions configures a PICC, the zero value is usable
+type PICCOptions struct {
+	// ATS including the TL byte is returned in response to RATS, it may be nil if the transport answers RATS itself
+	ATS []byte
+	// MaxFrameSize limits the size of frames sent excluding the CRC in addition to the FSD requested by the PCD
+	MaxFrameSize int
+
+	// WTXM is the waiting time extension multiplier requested with S(WTX) if the Handler takes longer than WTXAfter
+	// to process an APDU. WTX is disabled if WTXM or WTXAfter is zero.
+	WTXM byte
+	// WTXAfter should be less than the FWT minus any transport latency
+	WTXAfter time.Duration
+	// WTXTimeout is how long to wait for the S(WTX) response before WTX is disabled, defaults to WTXAfter
+	WTXTimeout time.Duration
+	// OnWTXUnsupported is called when an S(WTX) request is not answered, WTX is disabled afterwards
+	OnWTXUnsupported func(ctx context.Context, err error)
+
+	// Stats counts protocol events, it may be shared with other PICCs and a Router
+	Stats *Stats
+	// OnSessionStart is called when the PICC is activated by RATS
+	OnSessionStart func(ctx context.Context, cid uint8)
+	// OnSessionEnd is called when the PICC leaves the activated state
+	OnSessionEnd func(ctx context.Context, s Session)
+}
+
+// pendingExchange is a Handler exchange that is still running while waiting time extensions are requested
+type pendingExchange struct {
+	done   chan struct{}
+	rapdu  []byte
+	err    error
+	cancel context.CancelFunc
+	capdu  []byte
+}
+
+// PICC implements the card side of ISO/IEC 14443-4. Frames received from the PCD are passed to Process which returns
+// the frame to send back. Reassembled command APDUs are passed to the Handler.
+// A PICC is not safe for concurrent use.
+type PICC struct {
+	handler type4.Handler
+	opts    PICCOptions
+
+	cid         uint8
+	fsdi        uint8
+	blockNumber byte
+	lastBlock   []byte
+	chainingBuf []byte
+	// chainingNAD is the NAD from the first block of a chained command
+	chainingNAD *byte
+
+	// sendBuf holds the remainder of a chained response
+	sendBuf  []byte
+	sendHead Block
+
+	// pending is set while an S(WTX) request is outstanding
+	pending        *pendingExchange
+	wtxUnsupported bool
+	// wtxDeadline is when an unanswered S(WTX) request is given up on, zero if none is outstanding
+	wtxDeadline time.Time
+
+	// session is the current field activation, Start is zero if there is none
+	session Session
+}
+
+// NewPICC returns a PICC passing APDUs to handler
+func NewPICC(handler type4.Handler, opts PICCOptions) *PICC {
+	p := &PICC{
+		handler: handler,
+		opts:    opts,
+	}
+	p.Reset()
+	return p
+}
+
+// Active returns true if the PICC has received RATS and has not since been deselected
+func (p *PICC) Active() bool {
+	return p.cid != noCID
+}
+
+// CID returns the CID assigned by RATS
+func (p *PICC) CID() uint8 {
+	return p.cid
+}
+
+// FSD returns the maximum frame size the PCD is able to receive as indicated in RATS
+func (p *PICC) FSD() int {
+	return type4.FSC(p.fsdi)
+}
+
+// Reset returns the PICC to the not activated state without notifying the Handler, any session is ended with
+// SessionReset. A pending exchange is cancelled and Reset waits for the Handler to return.
+func (p *PICC) Reset() {
+	p.endSession(context.Background(), SessionReset)
+	p.cid = noCID
+	p.fsdi = DefaultFSDI
+	p.blockNumber = 0
+	p.lastBlock = nil
+	p.chainingBuf = nil
+	p.chainingNAD = nil
+	p.sendBuf = nil
+	// Background never expires so the Handler has always returned
+	_ = p.cancelPending(context.Background())
+}
+
+// WTXUnsupported returns true if an S(WTX) request went unanswered and WTX has been disabled
+func (p *PICC) WTXUnsupported() bool {
+	return p.wtxUnsupported
+}
+
+// Deadline returns when Timeout should be called if no frame is received from the PCD, zero if there is no S(WTX)
+// request outstanding
+func (p *PICC) Deadline() time.Time {
+	return p.wtxDeadline
+}
+
+// Timeout is called when no frame was received from the PCD by Deadline. If the S(WTX) request went unanswered WTX
+// is disabled and the frame to send is returned once the Handler completes. A nil response means nothing should be
+// sent.
+func (p *PICC) Timeout(ctx context.Context) (_ []byte, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	if p.pending == nil || p.wtxDeadline.IsZero() || time.Now().Before(p.wtxDeadline) {
+		return nil, nil
+	}
+
+	// The transport swallowed the S(WTX) response and is waiting for the response to the last I-Block
+	p.disableWTX(ctx, fmt.Errorf("%w after %s", ErrWTXNotForwarded, p.wtxTimeout()))
+	return p.awaitExchange(ctx, 0)
+}
+
+// Process handles a frame received from the PCD and returns the frame to send in response.
+// A nil response means nothing should be sent. An error is only returned if the context is cancelled while the
+// Handler is processing an APDU, Handler errors are otherwise answered with 6F00.
+func (p *PICC) Process(ctx context.Context, frame []byte) (_ []byte, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	if IsRATS(frame) {
+		p.opts.Stats.addRATS()
+		err = p.cancelPending(ctx)
+		if err != nil {
+			return
+		}
+		p.endSession(ctx, SessionReactivated)
+		p.Reset()
+		p.cid = frame[1] & 0x0F
+		p.fsdi = frame[1] & 0xF0 >> 4
+		// PICC block number is initialised to 1 on activation
+		p.blockNumber = 1
+		slog.DebugContext(ctx, "Got RATS", slog.Int("cid", int(p.cid)), slog.Int("fsdi", int(p.fsdi)))
+		p.startSession(ctx)
+		return p.opts.ATS, nil
+	}
+
+	block, err := ParseBlock(frame)
+	if err != nil {
+		p.opts.Stats.addBadFrame(err)
+		slog.WarnContext(ctx, "Bad block", rfid.ErrorAttrs(err), rfid.LogHex("frame", frame))
+		return nil, nil
+	}
+
+	if block.UnexpectedBits {
+		slog.WarnContext(ctx, block.Type.String()+"-Block with unexpected bits set", rfid.LogHex("frame", frame))
+	}
+
+	if block.HasCID && block.CID != p.cid {
+		p.opts.Stats.addIgnoredOtherCID()
+		slog.WarnContext(ctx, "Ignoring block for other CID", slog.Int("cid", int(block.CID)), rfid.LogHex("frame", frame))
+		return nil, nil
+	}
+
+	switch block.Type {
+	case BlockR:
+		return p.processR(ctx, block)
+	case BlockS:
+		return p.processS(ctx, block)
+	default:
+		return p.processI(ctx, block)
+	}
+}
+
+func (p *PICC) processR(ctx context.Context, block Block) ([]byte, error) {
+	if p.pending != nil {
+		if block.BlockNumber == p.blockNumber {
+			// Rule 11. The PCD did not receive the S(WTX) request, which is re-transmitted
+			slog.WarnContext(ctx, "R-Block triggering retransmit of S(WTX)", slog.String("block", block.String()))
+			p.opts.Stats.addRetransmit()
+			p.wtxDeadline = time.Now().Add(p.wtxTimeout())
+			return p.lastBlock, nil
+		}
+
+		// The PCD acknowledged its last I-Block and gave up waiting without answering the S(WTX) request
+		p.disableWTX(ctx, fmt.Errorf("%w: got %s", ErrWTXNotForwarded, block))
+
+		// The last I-Block sent by the PCD was received so the response is sent instead of retransmitting S(WTX)
+		return p.awaitExchange(ctx, 0)
+	}
+
+	if block.BlockNumber == p.blockNumber {
+		// Rule 11. When an R(ACK) or an R(NAK) block is received, if its block number is equal to the
+		// PICC’s current block number, the last block shall be re-transmitted.
+		slog.WarnContext(ctx, "R-Block triggering retransmit of last block", slog.String("block", block.String()))
+		p.opts.Stats.addRetransmit()
+		return p.lastBlock, nil
+	}
+
+	if block.NAK {
+		// Rule 12. When an R(NAK) block is received, if its block number is not equal to the
+		// PICC’s current block number, an R(ACK) block shall be sent.
+		return p.send(Block{
+			Type:        BlockR,
+			BlockNumber: p.blockNumber,
+			HasCID:      block.HasCID,
+			CID:         block.CID,
+		}), nil
+	}
+
+	if len(p.sendBuf) > 0 {
+		// Rule 13. When an R(ACK) block is received, if its block number is not equal to the PICC’s current block
+		// number, and the PICC is in chaining, chaining shall be continued.
+		p.blockNumber ^= 1
+		return p.sendChain(), nil
+	}
+
+	slog.WarnContext(ctx, "Unexpected R-Block chaining ACK", slog.String("block", block.String()))
+	return nil, nil
+}
+
+func (p *PICC) processS(ctx context.Context, block Block) ([]byte, error) {
+	if block.WTX {
+		// S(WTX) from the PCD is only valid as a response to a WTX request
+		if p.pending == nil {
+			slog.WarnContext(ctx, "Ignoring unexpected S(WTX)", slog.String("block", block.String()))
+			return nil, nil
+		}
+
+		wtxm := p.opts.WTXM
+		if len(block.INF) > 0 {
+			wtxm = block.INF[0] & 0x3F
+		}
+		slog.DebugContext(ctx, "Got S(WTX) response", slog.Int("wtxm", int(wtxm)))
+		return p.awaitExchange(ctx, p.opts.WTXAfter*time.Duration(wtxm))
+	}
+
+	slog.DebugContext(ctx, "DESELECT")
+	p.opts.Stats.addDeselect()
+	// The Handler must not be reset while it is still processing an APDU
+	err := p.cancelPending(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.endSession(ctx, SessionDeselected)
+	p.Reset()
+	p.handler.Reset(ctx)
+
+	// Acknowledge with the same block
+	return block.Bytes(), nil
+}
+
+func (p *PICC) processI(ctx context.Context, block Block) (_ []byte, err error) {
+	// Expect at least 1 INF byte after the header
+	if len(block.INF) == 0 {
+		slog.WarnContext(ctx, "Truncated block", slog.String("block", block.String()))
+		p.opts.Stats.addTruncated()
+		return nil, nil
+	}
+
+	// Rule D. When an I-Block is received the PICC shall toggle its block number before sending a block.
+	p.blockNumber = block.BlockNumber
+	// Any chained response or WTX in progress is abandoned, the Handler must return before it is passed another APDU
+	p.sendBuf = nil
+	err = p.cancelPending(ctx)
+	if err != nil {
+		return
+	}
+
+	if block.HasNAD && block.NAD&nadRFU != 0 {
+		slog.WarnContext(ctx, "NAD with RFU bits set", slog.String("block", block.String()))
+	}
+
+	// NAD is only sent in the first block of a chain and applies to the whole chain
+	if len(p.chainingBuf) > 0 {
+		if block.HasNAD {
+			slog.WarnContext(ctx, "Ignoring NAD in subsequent chained block", slog.String("block", block.String()))
+		}
+		block.HasNAD = p.chainingNAD != nil
+		if block.HasNAD {
+			block.NAD = *p.chainingNAD
+		}
+	}
+
+	if block.Chaining {
+		if len(p.chainingBuf) == 0 && block.HasNAD {
+			nad := block.NAD
+			p.chainingNAD = &nad
+		}
+
+		p.chainingBuf = append(p.chainingBuf, block.INF...)
+
+		return p.send(Block{
+			Type:        BlockR,
+			BlockNumber: p.blockNumber,
+			HasCID:      block.HasCID,
+			CID:         block.CID,
+		}), nil
+	}
+
+	capdu := block.INF
+	if len(p.chainingBuf) > 0 {
+		capdu = append(p.chainingBuf, capdu...)
+		p.chainingBuf = nil
+		p.chainingNAD = nil
+	}
+
+	handlerCtx := ctx
+	if block.HasNAD {
+		handlerCtx = type4.WithNAD(ctx, block.NAD)
+	}
+
+	p.sendHead = Block{
+		Type:   BlockI,
+		HasCID: block.HasCID,
+		CID:    block.CID,
+		HasNAD: block.HasNAD,
+		// Responses are addressed back to the source node
+		NAD: SwapNAD(block.NAD),
+	}
+
+	if p.opts.WTXM == 0 || p.opts.WTXAfter <= 0 || p.wtxUnsupported {
+		rapdu, err := p.exchange(handlerCtx, capdu)
+		return p.sendResponse(ctx, capdu, rapdu, err)
+	}
+
+	// The frame buffer may be reused by the transport while the Handler is still running
+	capdu = bytes.Clone(capdu)
+	handlerCtx, cancel := context.WithCancel(handlerCtx)
+	pending := &pendingExchange{
+		done:   make(chan struct{}),
+		cancel: cancel,
+		capdu:  capdu,
+	}
+	go func() {
+		defer close(pending.done)
+		pending.rapdu, pending.err = p.exchange(handlerCtx, capdu)
+	}()
+	p.pending = pending
+
+	return p.awaitExchange(ctx, p.opts.WTXAfter)
+}
+
+// disableWTX reports that an S(WTX) request went unanswered, the pending exchange is answered without WTX
+func (p *PICC) disableWTX(ctx context.Context, err error) {
+	p.wtxUnsupported = true
+	slog.WarnContext(ctx, "Disabling WTX", rfid.ErrorAttrs(err))
+	if p.opts.OnWTXUnsupported != nil {
+		p.opts.OnWTXUnsupported(ctx, err)
+	}
+}
+
+// wtxTimeout returns how long to wait for the S(WTX) response
+func (p *PICC) wtxTimeout() time.Duration {
+	if p.opts.WTXTimeout > 0 {
+		return p.opts.WTXTimeout
+	}
+	return p.opts.WTXAfter
+}
+
+// exchange passes an APDU to the Handler recording its latency
+func (p *PICC) exchange(ctx context.Context, capdu []byte) ([]byte, error) {
+	start := time.Now()
+	defer func() {
+		p.opts.Stats.addLatency(time.Since(start))
+	}()
+
+	return p.handler.Exchange(ctx, capdu)
+}
+
+// awaitExchange waits up to wait for the pending exchange, sending an S(WTX) request if it has not completed.
+// A wait of zero waits until the exchange completes.
+func (p *PICC) awaitExchange(ctx context.Context, wait time.Duration) (_ []byte, err error) {
+	pending := p.pending
+	// Only called once the S(WTX) request was answered or given up on
+	p.wtxDeadline = time.Time{}
+
+	var timeout <-chan time.Time
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-pending.done:
+		p.pending = nil
+		pending.cancel()
+		return p.sendResponse(ctx, pending.capdu, pending.rapdu, pending.err)
+	case <-timeout:
+		wtxm := min(p.opts.WTXM, maxWTXM)
+		slog.DebugContext(ctx, "Requesting WTX", slog.Int("wtxm", int(wtxm)))
+		p.wtxDeadline = time.Now().Add(p.wtxTimeout())
+		return p.send(Block{
+			Type:   BlockS,
+			WTX:    true,
+			HasCID: p.sendHead.HasCID,
+			CID:    p.sendHead.CID,
+			INF:    []byte{wtxm},
+		}), nil
+	case <-ctx.Done():
+		p.abandon()
+		err = context.Cause(ctx)
+		return
+	}
+}
+
+// abandon cancels any pending exchange without waiting for the Handler, it is only used once ctx is cancelled
+func (p *PICC) abandon() {
+	if p.pending != nil {
+		p.pending.cancel()
+		p.pending = nil
+	}
+	p.wtxDeadline = time.Time{}
+}
+
+// cancelPending cancels any pending exchange and waits for the Handler to return
+func (p *PICC) cancelPending(ctx context.Context) error {
+	pending := p.pending
+	if pending == nil {
+		return nil
+	}
+	p.pending = nil
+	p.wtxDeadline = time.Time{}
+	pending.cancel()
+
+	select {
+	case <-pending.done:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// sendResponse sends the result of a Handler exchange, replacing errors with 6F00
+func (p *PICC) sendResponse(ctx context.Context, capdu, rapdu []byte, err error) ([]byte, error) {
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		slog.WarnContext(ctx, "Failed to process APDU", rfid.ErrorAttrs(err), rfid.LogHex("apdu", capdu))
+		p.opts.Stats.addHandlerError()
+
+		// 6F00 Internal Exception
+		rapdu = []byte{0x6F, 0x00}
+	}
+
+	slog.DebugContext(ctx, "Sending rAPDU", rfid.LogHex("rapdu", rapdu))
+	p.session.APDUs++
+
+	p.sendBuf = rapdu
+
+	return p.sendChain(), nil
+}
+
+// maxFrameSize returns the largest frame that may be sent excluding the CRC
+func (p *PICC) maxFrameSize() int {
+	// FSD includes the 2 byte CRC
+	n := p.FSD() - 2
+	if p.opts.MaxFrameSize > 0 {
+		n = min(n, p.opts.MaxFrameSize)
+	}
+	return n
+}
+
+// sendChain sends the next block of the pending response, setting the chaining bit if it does not fit in one frame
+func (p *PICC) sendChain() []byte {
+	block := p.sendHead
+	block.BlockNumber = p.blockNumber
+
+	n := min(p.maxFrameSize()-block.HeaderLen(), len(p.sendBuf))
+	block.INF = p.sendBuf[:n]
+	p.sendBuf = p.sendBuf[n:]
+	block.Chaining = len(p.sendBuf) > 0
+
+	// NAD is only sent in the first block of a chain
+	p.sendHead.HasNAD = false
+
+	return p.send(block)
+}
+
+// send records the block as the last sent block for retransmission and returns it encoded
+func (p *PICC) send(block Block) []byte {
+	p.lastBlock = block.Bytes()
+	return p.lastBlock
+}
+
+func (p *PICC) startSession(ctx context.Context) {
+	p.session = Session{
+		CID:   p.cid,
+		Start: time.Now(),
+	}
+	p.opts.Stats.addSession(1)
+
+	if p.opts.OnSessionStart != nil {
+		p.opts.OnSessionStart(ctx, p.cid)
+	}
+}
+
+// endSession reports the end of the current session if the PICC is active
+func (p *PICC) endSession(ctx context.Context, reason SessionEndReason) {
+	if p.session.Start.IsZero() {
+		return
+	}
+
+	s := p.session
+	p.session = Session{}
+	s.End = time.Now()
+	s.Reason = reason
+	p.opts.Stats.addSession(-1)
+
+	slog.DebugContext(ctx, "ISO-DEP session ended", slog.Int("cid", int(s.CID)), slog.String("reason", reason.String()), slog.Duration("duration", s.Duration()), slog.Int("apdus", s.APDUs))
+
+	if p.opts.OnSessionEnd != nil {
+		p.opts.OnSessionEnd(ctx, s)
+	}
+}
@@ -0,0 +1,309 @@
+package isodep
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoHandler responds to every APDU with the APDU followed by 9000, APDUs starting with FF fail. It mirrors
+// cardhoppertest.EchoHandler, which is not used here as isodep must not depend on the pm3 packages, and also counts
+// resets.
+type echoHandler struct {
+	resets int
+}
+
+func (h *echoHandler) Exchange(_ context.Context, capdu []byte) ([]byte, error) {
+	if capdu[0] == 0xFF {
+		return nil, errors.New("boom")
+	}
+	return append(append([]byte(nil), capdu...), 0x90, 0x00), nil
+}
+
+func (h *echoHandler) Reset(context.Context) {
+	h.resets++
+}
+
+// unhex decodes hex test vectors ignoring spaces, it is kept local for the same reason as echoHandler
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+type frameVector struct {
+	name string
+	in   string
+	out  string
+}
+
+func runFrameVectors(t *testing.T, p Processor, vectors []frameVector) {
+	t.Helper()
+
+	for _, v := range vectors {
+		out, err := p.Process(context.Background(), unhex(v.in))
+		require.NoError(t, err, v.name)
+		assert.Equal(t, strings.ReplaceAll(v.out, " ", ""), strings.ToUpper(hex.EncodeToString(out)), v.name)
+	}
+}
+
+func TestPICC_Process(t *testing.T) {
+	t.Parallel()
+
+	h := &echoHandler{}
+	p := NewPICC(h, PICCOptions{ATS: unhex("0578338002")})
+
+	runFrameVectors(t, p, []frameVector{
+		{name: "RATS", in: "E050", out: "0578338002"},
+		{name: "I-Block", in: "02 0102", out: "02 0102 9000"},
+		{name: "I-Block toggled", in: "03 0304", out: "03 0304 9000"},
+		{name: "R(NAK) current block retransmits", in: "B3", out: "03 0304 9000"},
+		{name: "R(ACK) current block retransmits", in: "A3", out: "03 0304 9000"},
+		{name: "R(NAK) other block sends R(ACK)", in: "B2", out: "A3"},
+		{name: "chained I-Block", in: "12 AABB", out: "A2"},
+		{name: "chained I-Block 2", in: "13 CC", out: "A3"},
+		{name: "last chained I-Block", in: "02 DD", out: "02 AABBCCDD 9000"},
+		{name: "Handler error", in: "03 FF", out: "03 6F00"},
+		{name: "other CID", in: "0A 01 0102", out: ""},
+		{name: "CID 0", in: "0A 00 0102", out: "0A 00 0102 9000"},
+		{name: "NAD swapped", in: "0E 00 12 0102", out: "0E 00 21 0102 9000"},
+		{name: "chained I-Block with NAD", in: "1F 00 34 AA", out: "AB 00"},
+		{name: "last chained I-Block keeps NAD", in: "0A 00 BB", out: "0E 00 43 AABB 9000"},
+		{name: "bad PCB", in: "42", out: ""},
+		{name: "S(WTX) not requested", in: "F2 01", out: ""},
+		{name: "DESELECT", in: "C2", out: "C2"},
+	})
+
+	assert.False(t, p.Active())
+	assert.Equal(t, 1, h.resets)
+}
+
+func TestPICC_Process_responseChaining(t *testing.T) {
+	t.Parallel()
+
+	p := NewPICC(&echoHandler{}, PICCOptions{MaxFrameSize: 4})
+
+	runFrameVectors(t, p, []frameVector{
+		{name: "RATS", in: "E080", out: ""},
+		{name: "I-Block", in: "02 010203", out: "12 010203"},
+		{name: "R(ACK) continues chain", in: "A3", out: "03 9000"},
+		{name: "R(NAK) current block retransmits", in: "B3", out: "03 9000"},
+		{name: "R(ACK) other block after chain ends", in: "A2", out: ""},
+		{name: "NAD only in first block", in: "06 21 010203", out: "16 12 0102"},
+		{name: "R(ACK) continues chain without NAD", in: "A3", out: "03 039000"},
+		{name: "chained response", in: "02 01020304", out: "12 010203"},
+		{name: "new I-Block abandons chain", in: "03 05", out: "03 059000"},
+	})
+}
+
+func TestParseBlock(t *testing.T) {
+	t.Parallel()
+
+	b, err := ParseBlock(unhex("1E 05 21 0102"))
+	require.NoError(t, err)
+	assert.Equal(t, Block{
+		Type:     BlockI,
+		HasCID:   true,
+		CID:      5,
+		HasNAD:   true,
+		NAD:      0x21,
+		Chaining: true,
+		INF:      unhex("0102"),
+	}, b)
+	assert.Equal(t, unhex("1E 05 21 0102"), b.Bytes())
+	assert.Equal(t, "I(0) chaining CID=5 NAD=21 INF=0102", b.String())
+
+	_, err = ParseBlock(unhex("0A"))
+	require.ErrorIs(t, err, ErrTruncatedFrame)
+
+	_, err = ParseBlock(unhex("D2"))
+	require.ErrorIs(t, err, ErrBadPCB)
+}
+
+// slowHandler takes delay to process each APDU
+type slowHandler struct {
+	echoHandler
+	delay time.Duration
+}
+
+func (h *slowHandler) Exchange(ctx context.Context, capdu []byte) ([]byte, error) {
+	err := sleep(ctx, h.delay)
+	if err != nil {
+		return nil, err
+	}
+	return h.echoHandler.Exchange(ctx, capdu)
+}
+
+func TestPICC_Process_wtxNotForwarded(t *testing.T) {
+	t.Parallel()
+
+	var reported error
+	picc := NewPICC(&slowHandler{delay: 20 * time.Millisecond}, PICCOptions{
+		WTXM:     1,
+		WTXAfter: time.Millisecond,
+		OnWTXUnsupported: func(_ context.Context, err error) {
+			reported = err
+		},
+	})
+
+	runFrameVectors(t, picc, []frameVector{
+		{name: "RATS", in: "E080", out: ""},
+		{name: "I-Block", in: "02 01", out: "F2 01"},
+		{name: "R(NAK) retransmits S(WTX)", in: "B2", out: "F2 01"},
+		// the S(WTX) response was swallowed by the transport and the PCD gave up on the I-Block
+		{name: "R(ACK) sends response", in: "A3", out: "02 019000"},
+		{name: "WTX disabled", in: "03 02", out: "03 029000"},
+	})
+
+	require.ErrorIs(t, reported, ErrWTXNotForwarded)
+	assert.True(t, picc.WTXUnsupported())
+}
+
+func TestPICC_Timeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	var reported error
+	picc := NewPICC(&slowHandler{delay: 20 * time.Millisecond}, PICCOptions{
+		WTXM:       1,
+		WTXAfter:   time.Millisecond,
+		WTXTimeout: 5 * time.Millisecond,
+		OnWTXUnsupported: func(_ context.Context, err error) {
+			reported = err
+		},
+	})
+
+	runFrameVectors(t, picc, []frameVector{
+		{name: "RATS", in: "E080", out: ""},
+		{name: "I-Block", in: "02 01", out: "F2 01"},
+	})
+
+	deadline := picc.Deadline()
+	require.False(t, deadline.IsZero())
+	assert.WithinDuration(t, time.Now().Add(5*time.Millisecond), deadline, 5*time.Millisecond)
+
+	out, err := picc.Timeout(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, out, "deadline not reached")
+	require.NoError(t, reported)
+
+	// the transport swallowed the S(WTX) response
+	time.Sleep(time.Until(deadline))
+	out, err = picc.Timeout(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, unhex("02 019000"), out)
+	require.ErrorIs(t, reported, ErrWTXNotForwarded)
+	assert.True(t, picc.WTXUnsupported())
+	assert.True(t, picc.Deadline().IsZero())
+
+	runFrameVectors(t, picc, []frameVector{
+		{name: "WTX disabled", in: "03 02", out: "03 029000"},
+	})
+}
+
+// blockingHandler blocks each APDU until its context is cancelled, recording the order of calls
+type blockingHandler struct {
+	started chan struct{}
+	calls   []string
+}
+
+func (h *blockingHandler) Exchange(ctx context.Context, _ []byte) ([]byte, error) {
+	close(h.started)
+	<-ctx.Done()
+	time.Sleep(10 * time.Millisecond)
+	h.calls = append(h.calls, "exchange")
+	return nil, ctx.Err()
+}
+
+func (h *blockingHandler) Reset(context.Context) {
+	h.calls = append(h.calls, "reset")
+}
+
+func TestPICC_Process_deselectPending(t *testing.T) {
+	t.Parallel()
+
+	h := &blockingHandler{started: make(chan struct{})}
+	picc := NewPICC(h, PICCOptions{
+		WTXM:     1,
+		WTXAfter: time.Millisecond,
+	})
+
+	frame := unhex("02 01")
+	runFrameVectors(t, picc, []frameVector{
+		{name: "RATS", in: "E080", out: ""},
+	})
+	out, err := picc.Process(context.Background(), frame)
+	require.NoError(t, err)
+	assert.Equal(t, unhex("F2 01"), out)
+	<-h.started
+	// the transport reuses its buffer for the next frame
+	copy(frame, unhex("C2"))
+
+	runFrameVectors(t, picc, []frameVector{
+		{name: "DESELECT", in: "C2", out: "C2"},
+	})
+	assert.Equal(t, []string{"exchange", "reset"}, h.calls)
+	assert.False(t, picc.Active())
+}
+
+// serialHandler blocks the first APDU until its context is cancelled and records the most concurrent calls
+type serialHandler struct {
+	echoHandler
+
+	mu      sync.Mutex
+	calls   int
+	active  int
+	maxSeen int
+}
+
+func (h *serialHandler) Exchange(ctx context.Context, capdu []byte) ([]byte, error) {
+	h.mu.Lock()
+	h.calls++
+	first := h.calls == 1
+	h.active++
+	h.maxSeen = max(h.maxSeen, h.active)
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		h.active--
+		h.mu.Unlock()
+	}()
+
+	if first {
+		<-ctx.Done()
+		// returning late would overlap with the next APDU if the PICC did not wait
+		time.Sleep(20 * time.Millisecond)
+		return nil, ctx.Err()
+	}
+	return h.echoHandler.Exchange(ctx, capdu)
+}
+
+func TestPICC_Process_iBlockPending(t *testing.T) {
+	t.Parallel()
+
+	h := &serialHandler{}
+	picc := NewPICC(h, PICCOptions{
+		WTXM:     1,
+		WTXAfter: time.Millisecond,
+	})
+
+	runFrameVectors(t, picc, []frameVector{
+		{name: "RATS", in: "E080", out: ""},
+		{name: "I-Block", in: "02 01", out: "F2 01"},
+		// the PCD gave up on the first APDU and sent another
+		{name: "next I-Block", in: "03 02", out: "03 029000"},
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	assert.Equal(t, 2, h.calls)
+	assert.Equal(t, 1, h.maxSeen)
+}
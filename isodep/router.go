@@ -0,0 +1,182 @@
+package isodep
+
+import (
+	"context"
+	"fmt"
+	"github.com/nvx/go-rfid"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// maxCID is the largest CID that may be assigned, 15 is RFU
+const maxCID = 14
+
+// Processor handles frames received from a PCD returning the frame to send in response, nil if nothing should be sent
+type Processor interface {
+	Process(ctx context.Context, frame []byte) ([]byte, error)
+}
+
+var (
+	_ Processor = (*PICC)(nil)
+	_ Processor = (*Router)(nil)
+)
+
+// Router dispatches frames to one of several PICCs sharing a transport based on the CID, allowing a PCD to activate
+// multiple logical cards at once. Each PICC has its own block number, chaining and activation state.
+// A Router is not safe for concurrent use.
+type Router struct {
+	piccs    map[uint8]*PICC
+	fallback *PICC
+	stats    *Stats
+}
+
+// NewRouter returns a Router that activates fallback on RATS for any CID without a PICC added. fallback may be nil.
+// The fallback is a single PICC so while it is active RATS for another unknown CID is ignored until it is deselected.
+func NewRouter(fallback *PICC) *Router {
+	return &Router{
+		piccs:    make(map[uint8]*PICC),
+		fallback: fallback,
+	}
+}
+
+// Add registers a PICC to be activated by RATS with the given CID
+func (r *Router) Add(cid uint8, p *PICC) error {
+	if cid > maxCID {
+		return fmt.Errorf("CID %d out of range", cid)
+	}
+	r.piccs[cid] = p
+	return nil
+}
+
+// SetFallback replaces the PICC activated on RATS for any CID without a PICC added
+func (r *Router) SetFallback(p *PICC) {
+	r.fallback = p
+}
+
+// SetStats counts frames the Router ignores, it is usually the Stats shared by its PICCs
+func (r *Router) SetStats(s *Stats) {
+	r.stats = s
+}
+
+// Reset returns all PICCs to the not activated state
+func (r *Router) Reset() {
+	for _, p := range r.piccs {
+		p.Reset()
+	}
+	if r.fallback != nil {
+		r.fallback.Reset()
+	}
+}
+
+// Process dispatches the frame to the addressed PICC
+func (r *Router) Process(ctx context.Context, frame []byte) (_ []byte, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	if IsRATS(frame) {
+		cid := frame[1] & 0x0F
+		if p, ok := r.piccs[cid]; ok {
+			return p.Process(ctx, frame)
+		}
+		if r.fallback != nil {
+			if r.fallback.Active() && r.fallback.CID() != cid {
+				// activating the fallback again would silently drop the session of its current CID
+				r.stats.addIgnoredOtherCID()
+				slog.WarnContext(ctx, "Ignoring RATS while fallback is active with another CID", slog.Int("cid", int(cid)), slog.Int("active_cid", int(r.fallback.CID())))
+				return nil, nil
+			}
+			return r.fallback.Process(ctx, frame)
+		}
+		r.stats.addIgnoredOtherCID()
+		slog.WarnContext(ctx, "Ignoring RATS for unknown CID", slog.Int("cid", int(cid)))
+		return nil, nil
+	}
+
+	block, err := ParseBlock(frame)
+	if err != nil {
+		r.stats.addBadFrame(err)
+		slog.WarnContext(ctx, "Bad block", rfid.ErrorAttrs(err), rfid.LogHex("frame", frame))
+		return nil, nil
+	}
+
+	// A PICC with CID 0 also answers blocks without a CID
+	var cid uint8
+	if block.HasCID {
+		cid = block.CID
+	}
+
+	p := r.active(cid)
+	if p == nil && !block.HasCID && r.fallback != nil {
+		// Blocks without a CID are always accepted by the fallback
+		p = r.fallback
+	}
+	if p == nil {
+		r.stats.addIgnoredOtherCID()
+		slog.WarnContext(ctx, "Ignoring block for other CID", slog.Int("cid", int(cid)), rfid.LogHex("frame", frame))
+		return nil, nil
+	}
+
+	return p.Process(ctx, frame)
+}
+
+// Deadline returns the earliest Deadline of the PICCs, zero if none has an S(WTX) request outstanding
+func (r *Router) Deadline() time.Time {
+	if p := r.expiring(); p != nil {
+		return p.Deadline()
+	}
+	return time.Time{}
+}
+
+// Timeout is called when no frame was received from the PCD by Deadline, it is passed to the PICC with the earliest
+// Deadline. A nil response means nothing should be sent.
+func (r *Router) Timeout(ctx context.Context) ([]byte, error) {
+	p := r.expiring()
+	if p == nil {
+		return nil, nil
+	}
+	return p.Timeout(ctx)
+}
+
+// expiring returns the PICC with the earliest Deadline, nil if none has one
+func (r *Router) expiring() *PICC {
+	var next *PICC
+	consider := func(p *PICC) {
+		d := p.Deadline()
+		if !d.IsZero() && (next == nil || d.Before(next.Deadline())) {
+			next = p
+		}
+	}
+	for _, p := range r.piccs {
+		consider(p)
+	}
+	if r.fallback != nil {
+		consider(r.fallback)
+	}
+	return next
+}
+
+// Active returns the CIDs of the currently activated PICCs
+func (r *Router) Active() []uint8 {
+	var cids []uint8
+	for cid, p := range r.piccs {
+		if p.Active() {
+			cids = append(cids, cid)
+		}
+	}
+	if r.fallback != nil && r.fallback.Active() {
+		cids = append(cids, r.fallback.CID())
+	}
+	sort.Slice(cids, func(i, j int) bool { return cids[i] < cids[j] })
+	return cids
+}
+
+// active returns the activated PICC with the given CID, nil if none
+func (r *Router) active(cid uint8) *PICC {
+	if p, ok := r.piccs[cid]; ok && p.Active() {
+		return p
+	}
+	if r.fallback != nil && r.fallback.Active() && r.fallback.CID() == cid {
+		return r.fallback
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package isodep
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestRouter_Process(t *testing.T) {
+	t.Parallel()
+
+	h1, h2, fallback := &echoHandler{}, &echoHandler{}, &echoHandler{}
+	r := NewRouter(NewPICC(fallback, PICCOptions{}))
+	require.NoError(t, r.Add(1, NewPICC(h1, PICCOptions{})))
+	require.NoError(t, r.Add(2, NewPICC(h2, PICCOptions{})))
+	require.Error(t, r.Add(15, NewPICC(h2, PICCOptions{})))
+
+	runFrameVectors(t, r, []frameVector{
+		{name: "RATS CID 1", in: "E081", out: ""},
+		{name: "RATS CID 2", in: "E082", out: ""},
+		{name: "CID 1 I-Block", in: "0A 01 11", out: "0A 01 119000"},
+		{name: "CID 2 chained I-Block", in: "1A 02 22", out: "AA 02"},
+		{name: "CID 1 I-Block during CID 2 chain", in: "0B 01 12", out: "0B 01 129000"},
+		{name: "CID 2 last chained I-Block", in: "0B 02 23", out: "0B 02 22239000"},
+		{name: "CID 3 not active", in: "0A 03 11", out: ""},
+		{name: "DESELECT CID 1", in: "CA 01", out: "CA 01"},
+		{name: "CID 1 deselected", in: "0A 01 11", out: ""},
+		{name: "CID 2 still active", in: "0A 02 24", out: "0A 02 249000"},
+		{name: "RATS CID 5 uses fallback", in: "E085", out: ""},
+		{name: "fallback I-Block", in: "0A 05 55", out: "0A 05 559000"},
+	})
+
+	assert.Equal(t, []uint8{2, 5}, r.Active())
+	assert.Equal(t, 1, h1.resets)
+	assert.Equal(t, 0, h2.resets)
+}
+
+func TestRouter_fallbackOtherCID(t *testing.T) {
+	t.Parallel()
+
+	var ended []Session
+	stats := &Stats{}
+	r := NewRouter(NewPICC(&echoHandler{}, PICCOptions{
+		Stats: stats,
+		OnSessionEnd: func(_ context.Context, s Session) {
+			ended = append(ended, s)
+		},
+	}))
+	r.SetStats(stats)
+
+	runFrameVectors(t, r, []frameVector{
+		{name: "RATS CID 5 uses fallback", in: "E085", out: ""},
+		{name: "RATS CID 6 ignored", in: "E086", out: ""},
+		{name: "CID 5 still active", in: "0A 05 55", out: "0A 05 559000"},
+		{name: "CID 6 not active", in: "0A 06 66", out: ""},
+		{name: "DESELECT CID 5", in: "CA 05", out: "CA 05"},
+		{name: "RATS CID 6 after deselect", in: "E086", out: ""},
+		{name: "CID 6 I-Block", in: "0A 06 66", out: "0A 06 669000"},
+	})
+
+	assert.Equal(t, []uint8{6}, r.Active())
+	require.Len(t, ended, 1)
+	assert.Equal(t, uint8(5), ended[0].CID)
+	assert.Equal(t, SessionDeselected, ended[0].Reason)
+	assert.EqualValues(t, 2, stats.Snapshot().IgnoredOtherCID)
+}
+
+func TestRouter_Timeout(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	opts := PICCOptions{
+		WTXM:     1,
+		WTXAfter: time.Millisecond,
+	}
+	r := NewRouter(NewPICC(&slowHandler{delay: 20 * time.Millisecond}, opts))
+	require.NoError(t, r.Add(1, NewPICC(&slowHandler{delay: 20 * time.Millisecond}, opts)))
+	assert.True(t, r.Deadline().IsZero())
+
+	runFrameVectors(t, r, []frameVector{
+		{name: "RATS CID 1", in: "E011", out: ""},
+		{name: "I-Block CID 1", in: "0A 01 01", out: "FA 01 01"},
+	})
+	require.False(t, r.Deadline().IsZero())
+
+	time.Sleep(time.Until(r.Deadline()))
+	out, err := r.Timeout(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, unhex("0A 01 019000"), out)
+	assert.True(t, r.Deadline().IsZero())
+}
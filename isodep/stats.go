@@ -0,0 +1,196 @@
+package isodep
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionEndReason is why a PICC left the activated state
+type SessionEndReason uint8
+
+const (
+	// SessionDeselected is a session ended by S(DESELECT)
+	SessionDeselected SessionEndReason = iota
+	// SessionReactivated is a session ended by RATS, usually because the PCD reset the field without deselecting
+	SessionReactivated
+	// SessionReset is a session ended by resetting the PICC
+	SessionReset
+)
+
+func (r SessionEndReason) String() string {
+	switch r {
+	case SessionDeselected:
+		return "deselected"
+	case SessionReactivated:
+		return "reactivated"
+	case SessionReset:
+		return "reset"
+	default:
+		return "unknown"
+	}
+}
+
+// Session describes a field activation from RATS until the PICC is deactivated
+type Session struct {
+	CID    uint8
+	Start  time.Time
+	End    time.Time
+	APDUs  int
+	Reason SessionEndReason
+}
+
+// Duration returns how long the PICC was activated
+func (s Session) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// LatencyStats summarises a series of latencies such as how long the Handler took to process APDUs
+type LatencyStats struct {
+	Count uint64
+	Total time.Duration
+	Min   time.Duration
+	Max   time.Duration
+	Last  time.Duration
+}
+
+// Mean returns the average latency, zero if no APDUs were processed
+func (l LatencyStats) Mean() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.Total / time.Duration(l.Count)
+}
+
+// Add records a latency, it is not safe for concurrent use
+func (l *LatencyStats) Add(d time.Duration) {
+	if l.Count == 0 || d < l.Min {
+		l.Min = d
+	}
+	l.Max = max(l.Max, d)
+	l.Count++
+	l.Total += d
+	l.Last = d
+}
+
+// StatsSnapshot is a point in time copy of Stats
+type StatsSnapshot struct {
+	RATS      uint64
+	Deselects uint64
+	// Retransmits counts blocks resent in response to an R-Block, usually R(NAK)
+	Retransmits uint64
+	// IgnoredOtherCID counts frames ignored because they were addressed to a CID that is not active
+	IgnoredOtherCID uint64
+	BadPCB          uint64
+	// Truncated counts frames too short for their PCB and I-Blocks without INF
+	Truncated uint64
+	// HandlerErrors counts Handler errors answered with 6F00
+	HandlerErrors  uint64
+	ActiveSessions int64
+	HandlerLatency LatencyStats
+}
+
+// Stats counts protocol events of one or more PICCs and a Router. The zero value is ready to use and a nil *Stats
+// discards events. Stats is safe for concurrent use.
+type Stats struct {
+	rats            atomic.Uint64
+	deselects       atomic.Uint64
+	retransmits     atomic.Uint64
+	ignoredOtherCID atomic.Uint64
+	badPCB          atomic.Uint64
+	truncated       atomic.Uint64
+	handlerErrors   atomic.Uint64
+	activeSessions  atomic.Int64
+
+	mu      sync.Mutex
+	latency LatencyStats
+}
+
+// Snapshot returns a copy of the current counters
+func (s *Stats) Snapshot() StatsSnapshot {
+	if s == nil {
+		return StatsSnapshot{}
+	}
+
+	s.mu.Lock()
+	latency := s.latency
+	s.mu.Unlock()
+
+	return StatsSnapshot{
+		RATS:            s.rats.Load(),
+		Deselects:       s.deselects.Load(),
+		Retransmits:     s.retransmits.Load(),
+		IgnoredOtherCID: s.ignoredOtherCID.Load(),
+		BadPCB:          s.badPCB.Load(),
+		Truncated:       s.truncated.Load(),
+		HandlerErrors:   s.handlerErrors.Load(),
+		ActiveSessions:  s.activeSessions.Load(),
+		HandlerLatency:  latency,
+	}
+}
+
+func (s *Stats) addRATS() {
+	if s != nil {
+		s.rats.Add(1)
+	}
+}
+
+func (s *Stats) addDeselect() {
+	if s != nil {
+		s.deselects.Add(1)
+	}
+}
+
+func (s *Stats) addRetransmit() {
+	if s != nil {
+		s.retransmits.Add(1)
+	}
+}
+
+func (s *Stats) addIgnoredOtherCID() {
+	if s != nil {
+		s.ignoredOtherCID.Add(1)
+	}
+}
+
+func (s *Stats) addHandlerError() {
+	if s != nil {
+		s.handlerErrors.Add(1)
+	}
+}
+
+// addBadFrame counts a frame that ParseBlock rejected with err
+func (s *Stats) addBadFrame(err error) {
+	if s == nil {
+		return
+	}
+	if errors.Is(err, ErrBadPCB) {
+		s.badPCB.Add(1)
+	} else {
+		s.truncated.Add(1)
+	}
+}
+
+func (s *Stats) addTruncated() {
+	if s != nil {
+		s.truncated.Add(1)
+	}
+}
+
+func (s *Stats) addSession(delta int64) {
+	if s != nil {
+		s.activeSessions.Add(delta)
+	}
+}
+
+func (s *Stats) addLatency(d time.Duration) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latency.Add(d)
+}
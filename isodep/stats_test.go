@@ -0,0 +1,66 @@
+package isodep
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	stats := &Stats{}
+	var started []uint8
+	var ended []Session
+	opts := PICCOptions{
+		Stats: stats,
+		OnSessionStart: func(_ context.Context, cid uint8) {
+			started = append(started, cid)
+		},
+		OnSessionEnd: func(_ context.Context, s Session) {
+			ended = append(ended, s)
+		},
+	}
+
+	r := NewRouter(NewPICC(&echoHandler{}, opts))
+	r.SetStats(stats)
+
+	runFrameVectors(t, r, []frameVector{
+		{name: "RATS", in: "E081", out: ""},
+		{name: "I-Block", in: "0A 01 11", out: "0A 01 119000"},
+		{name: "R(NAK) retransmits", in: "BA 01", out: "0A 01 119000"},
+		{name: "Handler error", in: "0B 01 FF", out: "0B 01 6F00"},
+		{name: "other CID", in: "0A 02 11", out: ""},
+		{name: "bad PCB", in: "42", out: ""},
+		{name: "truncated", in: "0A", out: ""},
+		{name: "no INF", in: "0A 01", out: ""},
+		{name: "DESELECT", in: "CA 01", out: "CA 01"},
+		{name: "RATS again", in: "E080", out: ""},
+		{name: "RATS without DESELECT", in: "E080", out: ""},
+	})
+
+	s := stats.Snapshot()
+	assert.Equal(t, StatsSnapshot{
+		RATS:            3,
+		Deselects:       1,
+		Retransmits:     1,
+		IgnoredOtherCID: 1,
+		BadPCB:          1,
+		Truncated:       2,
+		HandlerErrors:   1,
+		ActiveSessions:  1,
+		HandlerLatency:  s.HandlerLatency,
+	}, s)
+	assert.EqualValues(t, 2, s.HandlerLatency.Count)
+
+	assert.Equal(t, []uint8{1, 0, 0}, started)
+	if assert.Len(t, ended, 2) {
+		assert.Equal(t, SessionDeselected, ended[0].Reason)
+		assert.Equal(t, 2, ended[0].APDUs)
+		assert.Equal(t, SessionReactivated, ended[1].Reason)
+	}
+
+	r.Reset()
+	assert.Len(t, ended, 3)
+	assert.Zero(t, stats.Snapshot().ActiveSessions)
+}
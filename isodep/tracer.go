@@ -0,0 +1,121 @@
+package isodep
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Direction is the sender of a traced frame
+type Direction uint8
+
+const (
+	// DirectionPCD is a frame sent by the PCD to the PICC
+	DirectionPCD Direction = iota
+	// DirectionPICC is a frame sent by the PICC to the PCD
+	DirectionPICC
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionPCD:
+		return "PCD"
+	case DirectionPICC:
+		return "PICC"
+	default:
+		return fmt.Sprintf("Direction(%d)", uint8(d))
+	}
+}
+
+// Frame is a raw frame seen by a FrameTracer
+type Frame struct {
+	Time      time.Time
+	Direction Direction
+	Raw       []byte
+	// RATS is set if Raw is a RATS rather than a block
+	RATS bool
+	// Block is the decoded frame, nil for RATS, frames that could not be decoded and frames of tags without ISO-DEP
+	Block *Block
+	// Err is the error decoding the frame
+	Err error
+}
+
+// NewFrame decodes raw, which must not be modified afterwards
+func NewFrame(t time.Time, dir Direction, raw []byte) Frame {
+	f := Frame{
+		Time:      t,
+		Direction: dir,
+		Raw:       raw,
+	}
+
+	if IsRATS(raw) {
+		f.RATS = true
+		return f
+	}
+
+	b, err := ParseBlock(raw)
+	if err != nil {
+		f.Err = err
+		return f
+	}
+	f.Block = &b
+
+	return f
+}
+
+func (f Frame) String() string {
+	var sb strings.Builder
+	_, _ = fmt.Fprintf(&sb, "%-4s %X", f.Direction, f.Raw)
+
+	switch {
+	case f.RATS:
+		_, _ = fmt.Fprintf(&sb, " RATS FSDI=%d CID=%d", f.Raw[1]>>4, f.Raw[1]&0x0F)
+	case f.Err != nil:
+		_, _ = fmt.Fprintf(&sb, " (%v)", f.Err)
+	case f.Block != nil:
+		sb.WriteString(" ")
+		sb.WriteString(f.Block.String())
+	}
+
+	return sb.String()
+}
+
+// FrameTracer receives every frame exchanged between a PCD and PICC. Frames must not be modified.
+type FrameTracer interface {
+	Frame(ctx context.Context, f Frame)
+}
+
+// FrameTracerFunc is an adapter allowing a function to be used as a FrameTracer
+type FrameTracerFunc func(ctx context.Context, f Frame)
+
+func (f FrameTracerFunc) Frame(ctx context.Context, frame Frame) {
+	f(ctx, frame)
+}
+
+type textFrameTracer struct {
+	mu   sync.Mutex
+	w    io.Writer
+	last time.Time
+}
+
+// NewTextFrameTracer returns a FrameTracer writing a human readable protocol log to w, one line per frame with the
+// time since the previous frame
+func NewTextFrameTracer(w io.Writer) FrameTracer {
+	return &textFrameTracer{w: w}
+}
+
+func (t *textFrameTracer) Frame(_ context.Context, f Frame) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var delta time.Duration
+	if !t.last.IsZero() {
+		delta = f.Time.Sub(t.last)
+	}
+	t.last = f.Time
+
+	_, _ = fmt.Fprintf(t.w, "%s %+10.3fms %s\n", f.Time.Format("15:04:05.000000"), float64(delta)/float64(time.Millisecond), f)
+}
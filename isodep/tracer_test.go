@@ -0,0 +1,30 @@
+package isodep
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextFrameTracer(t *testing.T) {
+	t.Parallel()
+
+	var sb strings.Builder
+	tracer := NewTextFrameTracer(&sb)
+
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	ctx := context.Background()
+	tracer.Frame(ctx, NewFrame(start, DirectionPCD, unhex("E081")))
+	tracer.Frame(ctx, NewFrame(start.Add(1500*time.Microsecond), DirectionPCD, unhex("1A0111")))
+	tracer.Frame(ctx, NewFrame(start.Add(2*time.Millisecond), DirectionPICC, unhex("AA01")))
+	tracer.Frame(ctx, NewFrame(start.Add(3*time.Millisecond), DirectionPCD, unhex("0F")))
+
+	assert.Equal(t, ""+
+		"03:04:05.000000     +0.000ms PCD  E081 RATS FSDI=8 CID=1\n"+
+		"03:04:05.001500     +1.500ms PCD  1A0111 I(0) chaining CID=1 INF=11\n"+
+		"03:04:05.002000     +0.500ms PICC AA01 R(ACK,0) CID=1\n"+
+		"03:04:05.003000     +1.000ms PCD  0F (truncated frame)\n",
+		sb.String())
+}
@@ -28,6 +28,6 @@ func (a *acker) Read(p []byte) (n int, err error) {
 
 func (a *acker) Write(p []byte) (n int, err error) {
 	n, err = a.rw.Write(p)
-	a.pendingAck = err == nil && !bytes.Equal(pm3.CommandEnterStandalone.Bytes(), p)
+	a.pendingAck = err == nil && !bytes.Equal(pm3.CommandEnterStandalone.Bytes(), p) && !bytes.Equal(pm3.CommandEnterStandalone.BytesCRC(), p)
 	return
 }
@@ -0,0 +1,31 @@
+package cardhoppertest
+
+import (
+	"context"
+	"errors"
+	"github.com/nvx/go-rfid/type4"
+)
+
+// EchoHandler responds to every APDU with the APDU followed by 9000, APDUs starting with FF fail
+type EchoHandler struct{}
+
+func (EchoHandler) Exchange(_ context.Context, capdu []byte) ([]byte, error) {
+	if len(capdu) > 0 && capdu[0] == 0xFF {
+		return nil, errors.New("boom")
+	}
+	return append(append([]byte(nil), capdu...), 0x90, 0x00), nil
+}
+
+func (EchoHandler) Reset(context.Context) {}
+
+// TestCard returns a card with a 4 byte UID and the ATS 0578807002 answering APDUs with EchoHandler, for use as the
+// emulated card and as the Card of a Simulator
+func TestCard() *type4.Emulator {
+	return &type4.Emulator{
+		UID:     []byte{0x04, 0x11, 0x22, 0x33},
+		SAK:     0x20,
+		ATQA:    []byte{0x04, 0x00},
+		ATS:     []byte{0x05, 0x78, 0x80, 0x70, 0x02},
+		Handler: EchoHandler{},
+	}
+}
@@ -0,0 +1,218 @@
+package cardhoppertest
+
+import (
+	"bytes"
+	"context"
+	"github.com/nvx/go-rfid/pm3/cardhopper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRelay(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := cardhopper.NewRelayServer(cardhopper.RelayServerOptions{})
+	served := make(chan error)
+	go func() {
+		served <- server.Serve(ctx, ln)
+	}()
+
+	readerDevice := New(Options{Card: TestCard()})
+	defer readerDevice.Close()
+	// a 254 byte R-APDU is chained in a 254 byte frame, the length of which is the same byte as an ACK
+	capdu := append(unhex("00D6000000"), bytes.Repeat([]byte{0xAB}, 247)...)
+	rapdu := append(bytes.Clone(capdu), 0x90, 0x00)
+	cardDevice := New(Options{Script: []Step{
+		{Reader: unhex("E080"), Want: unhex("0578807002")},
+		{Reader: unhex("02 00A4040000"), Want: unhex("02 00A4040000 9000")},
+		{Reader: append(unhex("03"), capdu...), Want: append(unhex("13"), rapdu[:253]...)},
+		{Reader: unhex("A2"), Want: append(unhex("02"), rapdu[253:]...)},
+		{Reader: unhex("C2"), Want: unhex("C2")},
+	}})
+	defer cardDevice.Close()
+
+	rctx, stop := context.WithCancel(ctx)
+	run := func(fn func(ctx context.Context, conn net.Conn) error) chan error {
+		done := make(chan error, 1)
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		go func() {
+			done <- fn(rctx, conn)
+		}()
+		return done
+	}
+
+	reader := cardhopper.NewRelayReader(readerDevice, cardhopper.ReaderOptions{SetupOptions: fastSetup})
+	readerDone := run(func(ctx context.Context, conn net.Conn) error {
+		return reader.Run(ctx, conn)
+	})
+
+	card := cardhopper.NewRelayCard(cardDevice, cardhopper.RelayCardOptions{Options: cardhopper.Options{SetupOptions: fastSetup}})
+	cardDone := run(func(ctx context.Context, conn net.Conn) error {
+		return card.Run(ctx, conn)
+	})
+
+	require.NoError(t, cardDevice.Wait(ctx))
+	assert.Equal(t, unhex("04112233"), cardDevice.Config().UID)
+
+	stop()
+	require.NoError(t, <-cardDone)
+	require.NoError(t, <-readerDone)
+	require.NoError(t, readerDevice.Err())
+
+	stats := server.Stats()
+	assert.EqualValues(t, 1, stats.Pairs)
+	assert.EqualValues(t, 4, stats.Frames)
+	assert.EqualValues(t, 4, stats.ReaderLatency.Count)
+	assert.EqualValues(t, 4, card.Stats().Count)
+	assert.EqualValues(t, 4, reader.Stats().Count)
+
+	cancel()
+	require.NoError(t, <-served)
+}
+
+func TestRelayServer_padding(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := cardhopper.NewRelayServer(cardhopper.RelayServerOptions{})
+	served := make(chan error)
+	go func() {
+		served <- server.Serve(ctx, ln)
+	}()
+
+	dial := func(mode cardhopper.Packet) net.Conn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+		_, err = conn.Write(mode.Bytes())
+		require.NoError(t, err)
+		return conn
+	}
+	expect := func(conn net.Conn, want []byte) {
+		got := make([]byte, len(want))
+		_, err := io.ReadFull(conn, got)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	reader := dial(cardhopper.MagicRead)
+	defer reader.Close()
+	expect(reader, []byte{0xFE})
+	card := dial(cardhopper.MagicCard)
+	defer card.Close()
+	expect(card, []byte{0xFE})
+
+	// a 254 byte packet is sent padded to 255 bytes so its length is not read as an ACK
+	frame := bytes.Repeat([]byte{0xAB}, 254)
+	padded := append(append([]byte{0xFF}, frame...), 0x00)
+	_, err = card.Write(padded)
+	require.NoError(t, err)
+	expect(card, []byte{0xFE})
+	expect(reader, padded)
+
+	_, err = reader.Write(cardhopper.MagicEnd.Bytes())
+	require.NoError(t, err)
+	expect(reader, []byte{0xFE})
+	expect(card, cardhopper.MagicEnd.Bytes())
+
+	cancel()
+	require.NoError(t, <-served)
+}
+
+// afterFuncCounter counts the context.AfterFunc registrations on it that have not been stopped
+type afterFuncCounter struct {
+	context.Context
+	active atomic.Int64
+}
+
+// Value hides the embedded context so the context package registers with AfterFunc
+func (c *afterFuncCounter) Value(any) any {
+	return nil
+}
+
+func (c *afterFuncCounter) AfterFunc(f func()) func() bool {
+	c.active.Add(1)
+	stop := context.AfterFunc(c.Context, f)
+	var once sync.Once
+	return func() bool {
+		once.Do(func() {
+			c.active.Add(-1)
+		})
+		return stop()
+	}
+}
+
+func TestRelayServer_peerCleanup(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	counter := &afterFuncCounter{Context: ctx}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := cardhopper.NewRelayServer(cardhopper.RelayServerOptions{})
+	served := make(chan error)
+	go func() {
+		served <- server.Serve(counter, ln)
+	}()
+
+	dial := func(mode cardhopper.Packet) net.Conn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+		_, err = conn.Write(mode.Bytes())
+		require.NoError(t, err)
+		ack := make([]byte, 1)
+		_, err = io.ReadFull(conn, ack)
+		require.NoError(t, err)
+		return conn
+	}
+	closed := func(conn net.Conn) {
+		_, err := io.Copy(io.Discard, conn)
+		require.NoError(t, err)
+	}
+
+	// a peer that disconnects while waiting for a partner
+	waiting := dial(cardhopper.MagicRead)
+	require.NoError(t, waiting.Close())
+	released := func() bool {
+		// only the registration of Serve itself remains
+		return counter.active.Load() == 1
+	}
+	require.Eventually(t, released, 5*time.Second, time.Millisecond)
+
+	// a pair ended by the reader
+	reader := dial(cardhopper.MagicRead)
+	defer reader.Close()
+	card := dial(cardhopper.MagicCard)
+	defer card.Close()
+	_, err = reader.Write(cardhopper.MagicEnd.Bytes())
+	require.NoError(t, err)
+	closed(reader)
+	closed(card)
+
+	require.Eventually(t, released, 5*time.Second, time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-served)
+}
@@ -0,0 +1,417 @@
+// Package cardhoppertest provides an in-memory CardHopper device for testing without a Proxmark3.
+package cardhoppertest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-rfid/isodep"
+	"github.com/nvx/go-rfid/pm3"
+	"github.com/nvx/go-rfid/pm3/cardhopper"
+	"github.com/nvx/go-rfid/type4"
+	"io"
+	"sync"
+)
+
+const ack = 0xFE
+
+// errEnd leaves standalone mode
+var errEnd = errors.New("end")
+
+var _ io.ReadWriteCloser = (*Simulator)(nil)
+
+// Step is one frame sent by the scripted reader in card mode
+type Step struct {
+	// Reader is the frame sent to the host excluding the CRC. If nil nothing is sent and the next packet from the host
+	// is the reply, as when the device swallows a frame from the reader.
+	Reader []byte
+	// Want is the frame the host must reply with, nil if no reply is expected. RATS is answered by the device with the
+	// configured ATS for ISO-DEP tag types and Want must equal it.
+	Want []byte
+}
+
+// Options configures a Simulator
+type Options struct {
+	// Script is played against the host once card mode has been set up. If card mode is set up again the script
+	// continues from where it was interrupted.
+	Script []Step
+	// Card is the card found in reader mode, it must have a Handler
+	Card *type4.Emulator
+}
+
+// Config is the card mode configuration received from the host
+type Config struct {
+	Type cardhopper.TagType
+	FWI  byte
+	SFGI byte
+	UID  []byte
+	ATS  []byte
+}
+
+// Simulator is an in-memory CardHopper device running the standalone firmware. The host side of the serial link is
+// accessed with Read and Write. Protocol violations by the host and unexpected replies are reported by Wait.
+type Simulator struct {
+	opts Options
+
+	in  *io.PipeReader
+	inW *io.PipeWriter
+	r   *bufio.Reader
+	out outQueue
+
+	mu     sync.Mutex
+	config Config
+	step   int
+	errs   []error
+	// done is closed once the script has been played
+	done chan struct{}
+	// stopped is closed when the firmware stops
+	stopped chan struct{}
+}
+
+// New starts a Simulator, Close must be called to stop it
+func New(opts Options) *Simulator {
+	in, inW := io.Pipe()
+	s := &Simulator{
+		opts:    opts,
+		in:      in,
+		inW:     inW,
+		r:       bufio.NewReader(in),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	s.out.cond = sync.NewCond(&s.out.mu)
+	if len(opts.Script) == 0 {
+		close(s.done)
+	}
+
+	go s.run()
+
+	return s
+}
+
+// Read reads data sent by the device to the host
+func (s *Simulator) Read(p []byte) (int, error) {
+	return s.out.read(p)
+}
+
+// Write sends data from the host to the device
+func (s *Simulator) Write(p []byte) (int, error) {
+	return s.inW.Write(p)
+}
+
+// Close stops the firmware, pending and future reads return io.EOF
+func (s *Simulator) Close() error {
+	_ = s.in.Close()
+	s.out.close()
+	<-s.stopped
+	return nil
+}
+
+// Config returns the last card mode configuration received
+func (s *Simulator) Config() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.config
+}
+
+// Wait waits until the script has been played or the firmware stopped, returning any errors seen
+func (s *Simulator) Wait(ctx context.Context) error {
+	select {
+	case <-s.done:
+	case <-s.stopped:
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+
+	return s.Err()
+}
+
+// Err returns the errors seen so far
+func (s *Simulator) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return errors.Join(s.errs...)
+}
+
+func (s *Simulator) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.errs = append(s.errs, err)
+}
+
+func (s *Simulator) run() {
+	defer close(s.stopped)
+
+	err := s.firmware()
+	if err != nil && !errors.Is(err, io.ErrClosedPipe) && !errors.Is(err, io.EOF) {
+		s.fail(err)
+	}
+}
+
+// firmware waits for the host to enter standalone mode then runs the CardHopper mode selection until END
+func (s *Simulator) firmware() error {
+	standalone := pm3.CommandEnterStandalone.Bytes()
+	for {
+		b := make([]byte, len(standalone))
+		_, err := io.ReadFull(s.r, b)
+		if err != nil {
+			return err
+		}
+		// the command is sent with a CRC over UART
+		if !bytes.Equal(b, standalone) && !bytes.Equal(b, pm3.CommandEnterStandalone.BytesCRC()) {
+			return fmt.Errorf("expected standalone command, got %X", b)
+		}
+
+		err = s.modeSelection()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Simulator) modeSelection() error {
+	for {
+		p, err := s.readPacket()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case p.Equal(cardhopper.MagicCard):
+			s.ack()
+			err = s.card()
+		case p.Equal(cardhopper.MagicRead):
+			s.ack()
+			err = s.reader()
+		case p.Equal(cardhopper.MagicRestart):
+			// already in mode selection
+		case p.Equal(cardhopper.MagicEnd):
+			return nil
+		default:
+			return fmt.Errorf("unexpected packet in mode selection: %X", []byte(p))
+		}
+		if errors.Is(err, errEnd) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readPacket reads a packet from the host without acknowledging it
+func (s *Simulator) readPacket() (p cardhopper.Packet, err error) {
+	_, err = p.ReadFrom(s.r)
+	return
+}
+
+// readCommand reads a packet and acknowledges it, errEnd is returned for END and io.EOF for RESTART which are not
+// acknowledged
+func (s *Simulator) readCommand() (p cardhopper.Packet, err error) {
+	p, err = s.readPacket()
+	if err != nil {
+		return
+	}
+
+	switch {
+	case p.Equal(cardhopper.MagicRestart):
+		err = io.EOF
+	case p.Equal(cardhopper.MagicEnd):
+		err = errEnd
+	default:
+		s.ack()
+	}
+	return
+}
+
+func (s *Simulator) ack() {
+	s.out.write([]byte{ack})
+}
+
+func (s *Simulator) writePacket(p cardhopper.Packet) {
+	s.out.write(p.Bytes())
+}
+
+// card receives the card mode setup and plays the script
+func (s *Simulator) card() error {
+	var config Config
+	var fields [4]cardhopper.Packet
+	for i := range fields {
+		p, err := s.readCommand()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fields[i] = bytes.Clone(p)
+	}
+
+	tagType, timing, uid, ats := fields[0], fields[1], fields[2], fields[3]
+	if len(tagType) != 1 || !cardhopper.TagType(tagType[0]).Valid() {
+		return fmt.Errorf("bad tag type: %X", []byte(tagType))
+	}
+	config.Type = cardhopper.TagType(tagType[0])
+
+	if len(timing) != 2 || timing[0] > 14 || timing[1] > 14 {
+		return fmt.Errorf("bad timing: %X", []byte(timing))
+	}
+	config.FWI, config.SFGI = timing[0], timing[1]
+
+	if len(uid) != 4 && len(uid) != 7 && len(uid) != 10 {
+		return fmt.Errorf("bad UID length: %X", []byte(uid))
+	}
+	config.UID = uid
+
+	if config.Type.ISODEP() {
+		parsed, err := type4.ParseATS(ats)
+		if err != nil {
+			return fmt.Errorf("bad ATS %X: %w", []byte(ats), err)
+		}
+		if parsed.FWI != config.FWI || parsed.SFGI != config.SFGI {
+			return fmt.Errorf("timing %X does not match ATS %X", []byte(timing), []byte(ats))
+		}
+	} else if len(ats) != 0 {
+		return fmt.Errorf("unexpected ATS for %s: %X", config.Type, []byte(ats))
+	}
+	config.ATS = ats
+
+	s.mu.Lock()
+	s.config = config
+	s.mu.Unlock()
+
+	return s.emulate(config)
+}
+
+// emulate plays the remaining script then waits for the host to leave card mode
+func (s *Simulator) emulate(config Config) error {
+	for {
+		s.mu.Lock()
+		i := s.step
+		s.mu.Unlock()
+		if i >= len(s.opts.Script) {
+			break
+		}
+		step := s.opts.Script[i]
+
+		var resp []byte
+		if step.Reader != nil {
+			s.writePacket(step.Reader)
+		}
+		if config.Type.ISODEP() && isodep.IsRATS(step.Reader) {
+			resp = config.ATS
+		} else {
+			p, err := s.readCommand()
+			if errors.Is(err, io.EOF) {
+				// restarted before replying
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			resp = p
+		}
+
+		if !bytes.Equal(resp, step.Want) {
+			s.fail(fmt.Errorf("step %d: reader sent %X, want reply %X, got %X", i, step.Reader, step.Want, resp))
+		}
+
+		s.mu.Lock()
+		s.step++
+		if s.step == len(s.opts.Script) {
+			close(s.done)
+		}
+		s.mu.Unlock()
+	}
+
+	p, err := s.readCommand()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("unexpected packet in card mode after script: %X", []byte(p))
+}
+
+// reader reports the identity of the card then forwards frames from the host to it
+func (s *Simulator) reader() error {
+	card := s.opts.Card
+	if card == nil {
+		return errors.New("reader mode without a card")
+	}
+
+	for _, p := range []cardhopper.Packet{card.UID, card.ATQA, {card.SAK}, card.ATS} {
+		s.writePacket(p)
+	}
+
+	picc := isodep.NewPICC(card.Handler, isodep.PICCOptions{})
+	defer card.Handler.Reset(context.Background())
+
+	// the device has already performed RATS with FSDI 8 and CID 0
+	_, err := picc.Process(context.Background(), []byte{0xE0, 0x80})
+	if err != nil {
+		return err
+	}
+
+	for {
+		p, err := s.readCommand()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp, err := picc.Process(context.Background(), p)
+		if err != nil {
+			return err
+		}
+		s.writePacket(resp)
+	}
+}
+
+// outQueue buffers data sent by the device until the host reads it
+type outQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	closed bool
+}
+
+func (q *outQueue) write(p []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.buf = append(q.buf, p...)
+	q.cond.Broadcast()
+}
+
+func (q *outQueue) read(p []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.buf) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.buf) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, q.buf)
+	q.buf = q.buf[n:]
+	return n, nil
+}
+
+func (q *outQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
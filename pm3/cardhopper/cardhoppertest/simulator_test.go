@@ -0,0 +1,273 @@
+package cardhoppertest
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/nvx/go-rfid/isodep"
+	"github.com/nvx/go-rfid/pm3"
+	"github.com/nvx/go-rfid/pm3/cardhopper"
+	"github.com/nvx/go-rfid/type4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// slowHandler echoes APDUs after delay
+type slowHandler struct {
+	EchoHandler
+	delay time.Duration
+}
+
+func (h slowHandler) Exchange(ctx context.Context, capdu []byte) ([]byte, error) {
+	select {
+	case <-time.After(h.delay):
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+	return h.EchoHandler.Exchange(ctx, capdu)
+}
+
+var fastSetup = cardhopper.SetupOptions{
+	StandaloneDelay: time.Millisecond,
+	RestartDelay:    time.Millisecond,
+}
+
+func TestSimulator_card(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	steps := []Step{
+		{Reader: unhex("E080"), Want: unhex("0578807002")},
+		{Reader: unhex("02 00A4040000"), Want: unhex("02 00A4040000 9000")},
+		{Reader: unhex("13 AABB"), Want: unhex("A3")},
+		{Reader: unhex("02 CC"), Want: unhex("02 AABBCC 9000")},
+		{Reader: unhex("B2"), Want: unhex("02 AABBCC 9000")},
+		{Reader: unhex("03 FF"), Want: unhex("03 6F00")},
+		{Reader: unhex("0A 05 11"), Want: nil},
+		{Reader: unhex("C2"), Want: unhex("C2")},
+	}
+	sim := New(Options{Script: steps})
+	defer sim.Close()
+
+	e := cardhopper.NewWithOptions(sim, TestCard(), cardhopper.Options{SetupOptions: fastSetup})
+	require.NoError(t, e.Setup(ctx))
+	assert.Equal(t, Config{
+		Type: cardhopper.TagTypeJavacard,
+		FWI:  7,
+		SFGI: 0,
+		UID:  unhex("04112233"),
+		ATS:  unhex("0578807002"),
+	}, sim.Config())
+
+	ectx, stop := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- e.Emulate(ectx)
+	}()
+
+	require.NoError(t, sim.Wait(ctx))
+	stop()
+	require.NoError(t, <-done)
+	require.NoError(t, e.Close())
+
+	stats := e.Stats()
+	assert.EqualValues(t, 1, stats.RATS)
+	assert.EqualValues(t, 1, stats.Deselects)
+	assert.EqualValues(t, 1, stats.Retransmits)
+	assert.EqualValues(t, 1, stats.HandlerErrors)
+	assert.EqualValues(t, 1, stats.IgnoredOtherCID)
+}
+
+func TestSimulator_wtxSwallowed(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	steps := []Step{
+		{Reader: unhex("E080"), Want: unhex("0578807002")},
+		{Reader: unhex("02 00A4040000"), Want: unhex("F2 01")},
+		// the device does not forward the reader's S(WTX) response
+		{Reader: nil, Want: unhex("02 00A4040000 9000")},
+		{Reader: unhex("03 01"), Want: unhex("03 01 9000")},
+	}
+	sim := New(Options{Script: steps})
+	defer sim.Close()
+
+	card := TestCard()
+	card.Handler = slowHandler{delay: 50 * time.Millisecond}
+	var reported error
+	e := cardhopper.NewWithOptions(sim, card, cardhopper.Options{
+		SetupOptions: fastSetup,
+		WTXM:         1,
+		WTXAfter:     5 * time.Millisecond,
+		OnWTXUnsupported: func(_ context.Context, err error) {
+			reported = err
+		},
+	})
+	require.NoError(t, e.Setup(ctx))
+
+	ectx, stop := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- e.Emulate(ectx)
+	}()
+
+	require.NoError(t, sim.Wait(ctx))
+	stop()
+	require.NoError(t, <-done)
+	require.NoError(t, e.Close())
+
+	require.ErrorIs(t, reported, isodep.ErrWTXNotForwarded)
+}
+
+func TestSimulator_reader(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		link pm3.Link
+	}{
+		{"USB", pm3.LinkUSB},
+		// the standalone command is sent with a CRC over UART
+		{"UART", pm3.LinkUART},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			sim := New(Options{Card: TestCard()})
+			defer sim.Close()
+
+			setup := fastSetup
+			setup.Link = tt.link
+			r := cardhopper.NewReader(sim, cardhopper.ReaderOptions{SetupOptions: setup})
+			identity, err := r.Setup(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, unhex("04112233"), identity.UID)
+			assert.Equal(t, unhex("0578807002"), identity.ATS)
+
+			rapdu, err := r.Exchange(ctx, unhex("00A4040000"))
+			require.NoError(t, err)
+			assert.Equal(t, unhex("00A4040000 9000"), rapdu)
+
+			r.Reset(ctx)
+			rapdu, err = r.Exchange(ctx, unhex("0102"))
+			require.NoError(t, err)
+			assert.Equal(t, unhex("0102 9000"), rapdu)
+
+			require.NoError(t, r.Close())
+			require.NoError(t, sim.Err())
+		})
+	}
+}
+
+func TestSimulator_setEmulator(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sim := New(Options{})
+	defer sim.Close()
+
+	e := cardhopper.NewWithOptions(sim, TestCard(), cardhopper.Options{SetupOptions: fastSetup})
+	require.NoError(t, e.Setup(ctx))
+
+	ectx, stop := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- e.Emulate(ectx)
+	}()
+
+	card := TestCard()
+	card.UID = unhex("04AABBCCDDEEFF")
+	card.ATQA = unhex("4400")
+	require.NoError(t, e.SetEmulator(ctx, card))
+	assert.Equal(t, card.UID, sim.Config().UID)
+
+	stop()
+	require.NoError(t, <-done)
+	require.NoError(t, e.Close())
+	require.NoError(t, sim.Err())
+}
+
+func TestCardHopper_AddEmulator(t *testing.T) {
+	t.Parallel()
+
+	sim := New(Options{})
+	defer sim.Close()
+
+	e := cardhopper.New(sim, TestCard())
+
+	// only the Handler and ATS timing of added emulators are used
+	require.NoError(t, e.AddEmulator(1, &type4.Emulator{Handler: EchoHandler{}}))
+	require.NoError(t, e.AddEmulator(2, &type4.Emulator{ATS: unhex("0578807002"), Handler: EchoHandler{}}))
+	assert.Error(t, e.AddEmulator(3, &type4.Emulator{}))
+	assert.Error(t, e.AddEmulator(4, &type4.Emulator{ATS: unhex("05"), Handler: EchoHandler{}}))
+	assert.Error(t, e.AddEmulator(15, &type4.Emulator{Handler: EchoHandler{}}))
+}
+
+func TestSimulator_setEmulatorMidSession(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sim := New(Options{Script: []Step{
+		{Reader: unhex("E080"), Want: unhex("0578807002")},
+		{Reader: unhex("02 00A4040000"), Want: unhex("02 00A4040000 9000")},
+	}})
+	defer sim.Close()
+
+	ended := make(chan isodep.Session, 1)
+	e := cardhopper.NewWithOptions(sim, TestCard(), cardhopper.Options{
+		SetupOptions: fastSetup,
+		OnSessionEnd: func(_ context.Context, s isodep.Session) {
+			ended <- s
+		},
+	})
+	require.NoError(t, e.Setup(ctx))
+
+	ectx, stop := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- e.Emulate(ectx)
+	}()
+
+	// the reader is still talking to the card when it is swapped
+	require.NoError(t, sim.Wait(ctx))
+	assert.EqualValues(t, 1, e.Stats().ActiveSessions)
+
+	card := TestCard()
+	card.UID = unhex("08AABBCC")
+	require.NoError(t, e.SetEmulator(ctx, card))
+
+	select {
+	case s := <-ended:
+		assert.Equal(t, isodep.SessionReset, s.Reason)
+		assert.Equal(t, 1, s.APDUs)
+	case <-ctx.Done():
+		t.Fatal("session not ended")
+	}
+	assert.EqualValues(t, 0, e.Stats().ActiveSessions)
+
+	stop()
+	require.NoError(t, <-done)
+	require.NoError(t, e.Close())
+	require.NoError(t, sim.Err())
+}
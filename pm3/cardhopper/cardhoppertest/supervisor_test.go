@@ -0,0 +1,231 @@
+package cardhoppertest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/nvx/go-rfid/pm3/cardhopper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingPort records everything the host writes to the Simulator
+type recordingPort struct {
+	*Simulator
+
+	mu      sync.Mutex
+	written []byte
+}
+
+func (p *recordingPort) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	p.written = append(p.written, b...)
+	p.mu.Unlock()
+
+	return p.Simulator.Write(b)
+}
+
+// ended returns true if the host left standalone mode
+func (p *recordingPort) ended() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return bytes.HasSuffix(p.written, cardhopper.MagicEnd.Bytes())
+}
+
+type disconnect struct {
+	err     error
+	attempt int
+	backoff time.Duration
+}
+
+func TestSupervisor_reconnect(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sim := New(Options{Script: []Step{
+		{Reader: unhex("E080"), Want: unhex("0578807002")},
+		{Reader: unhex("02 00A4040000"), Want: unhex("02 00A4040000 9000")},
+	}})
+	port := &recordingPort{Simulator: sim}
+	errDial := errors.New("no device")
+
+	var dials, configured int
+	var disconnects []disconnect
+	connected := make(chan int, 1)
+	s := cardhopper.NewSupervisor(TestCard(), cardhopper.SupervisorOptions{
+		Options: cardhopper.Options{SetupOptions: fastSetup},
+		// the device appears on the third attempt
+		Dial: func(context.Context) (io.ReadWriteCloser, error) {
+			dials++
+			if dials < 3 {
+				return nil, errDial
+			}
+			return port, nil
+		},
+		Configure: func(e *cardhopper.CardHopper) error {
+			configured++
+			return nil
+		},
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 15 * time.Millisecond,
+		OnConnected: func(_ context.Context, _ *cardhopper.CardHopper, attempt int) {
+			connected <- attempt
+		},
+		OnDisconnected: func(_ context.Context, err error, attempt int, backoff time.Duration) {
+			disconnects = append(disconnects, disconnect{err, attempt, backoff})
+		},
+	})
+
+	rctx, stop := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- s.Run(rctx)
+	}()
+
+	select {
+	case attempt := <-connected:
+		assert.Equal(t, 2, attempt)
+	case <-ctx.Done():
+		t.Fatal("not connected")
+	}
+	require.NoError(t, sim.Wait(ctx))
+
+	// the device is returned to the Proxmark3 OS when stopped
+	stop()
+	require.NoError(t, <-done)
+	assert.True(t, port.ended())
+	require.NoError(t, sim.Err())
+
+	assert.Equal(t, 3, dials)
+	assert.Equal(t, 1, configured)
+	require.Len(t, disconnects, 2)
+	for i, d := range disconnects {
+		assert.ErrorIs(t, d.err, errDial)
+		assert.Equal(t, i+1, d.attempt)
+	}
+	assert.Equal(t, 10*time.Millisecond, disconnects[0].backoff)
+	assert.Equal(t, 15*time.Millisecond, disconnects[1].backoff)
+}
+
+func TestSupervisor_idleTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var ports []*recordingPort
+	var disconnects []disconnect
+	var connects []int
+	rctx, stop := context.WithCancel(ctx)
+	s := cardhopper.NewSupervisor(TestCard(), cardhopper.SupervisorOptions{
+		Options: cardhopper.Options{SetupOptions: fastSetup},
+		// the reader never sends anything
+		Dial: func(context.Context) (io.ReadWriteCloser, error) {
+			p := &recordingPort{Simulator: New(Options{})}
+			ports = append(ports, p)
+			return p, nil
+		},
+		IdleTimeout: 50 * time.Millisecond,
+		MinBackoff:  time.Millisecond,
+		OnConnected: func(_ context.Context, _ *cardhopper.CardHopper, attempt int) {
+			connects = append(connects, attempt)
+		},
+		OnDisconnected: func(_ context.Context, err error, attempt int, backoff time.Duration) {
+			disconnects = append(disconnects, disconnect{err, attempt, backoff})
+			if len(disconnects) == 2 {
+				stop()
+			}
+		},
+	})
+
+	require.NoError(t, s.Run(rctx))
+
+	// the lost link counts as one failed attempt, each connection succeeded so the backoff was not increased
+	assert.Equal(t, []int{0, 1}, connects)
+	require.Len(t, disconnects, 2)
+	for _, d := range disconnects {
+		assert.ErrorIs(t, d.err, cardhopper.ErrIdleTimeout)
+		assert.Equal(t, disconnect{d.err, 1, time.Millisecond}, d)
+	}
+	require.Len(t, ports, 2)
+	for _, p := range ports {
+		assert.True(t, p.ended())
+		require.NoError(t, p.Err())
+	}
+}
+
+func TestSupervisor_keepsConfiguration(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	card := TestCard()
+	card.UID = unhex("04AABBCCDDEEFF")
+	card.ATQA = unhex("4400")
+
+	sims := []*Simulator{
+		New(Options{Script: []Step{
+			{Reader: unhex("E080"), Want: unhex("0578807002")},
+			{Reader: unhex("02 00A4040000"), Want: unhex("02 00A4040000 9000")},
+		}}),
+		New(Options{Script: []Step{
+			{Reader: unhex("E080"), Want: unhex("0578807002")},
+			{Reader: unhex("02 0102"), Want: unhex("02 0102 9000")},
+		}}),
+	}
+	for _, sim := range sims {
+		defer sim.Close()
+	}
+
+	var mu sync.Mutex
+	var dials int
+	s := cardhopper.NewSupervisor(TestCard(), cardhopper.SupervisorOptions{
+		Options: cardhopper.Options{SetupOptions: fastSetup},
+		Dial: func(context.Context) (io.ReadWriteCloser, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			dials++
+			if dials > len(sims) {
+				return New(Options{}), nil
+			}
+			return sims[dials-1], nil
+		},
+		// the first link is dropped once the reader goes quiet
+		IdleTimeout: 200 * time.Millisecond,
+		MinBackoff:  time.Millisecond,
+	})
+
+	rctx, stop := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- s.Run(rctx)
+	}()
+
+	require.NoError(t, sims[0].Wait(ctx))
+	require.NoError(t, s.SetEmulator(ctx, card))
+	assert.Equal(t, card.UID, sims[0].Config().UID)
+
+	// the emulator and the counters survive the reconnection
+	require.NoError(t, sims[1].Wait(ctx))
+	assert.Equal(t, card.UID, sims[1].Config().UID)
+	stats := s.Stats()
+	assert.EqualValues(t, 2, stats.RATS)
+	assert.True(t, stats.Emulating)
+
+	stop()
+	require.NoError(t, <-done)
+	for _, sim := range sims {
+		require.NoError(t, sim.Err())
+	}
+	assert.False(t, s.Stats().Emulating)
+	assert.EqualValues(t, 2, s.Stats().RATS)
+}
@@ -0,0 +1,169 @@
+package cardhoppertest
+
+import (
+	"context"
+	"github.com/nvx/go-rfid/pm3"
+	"github.com/nvx/go-rfid/pm3/cardhopper"
+	"github.com/nvx/go-rfid/type4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// frameRecorder records every frame and answers it with the frame reversed
+type frameRecorder struct {
+	mu     sync.Mutex
+	frames [][]byte
+	resets int
+}
+
+func (h *frameRecorder) HandleFrame(_ context.Context, frame []byte) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.frames = append(h.frames, append([]byte(nil), frame...))
+	reply := make([]byte, len(frame))
+	for i, b := range frame {
+		reply[len(frame)-1-i] = b
+	}
+	return reply, nil
+}
+
+func (h *frameRecorder) Reset(context.Context) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.resets++
+}
+
+func (h *frameRecorder) Frames() [][]byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.frames
+}
+
+// emulate runs Emulate until the script has been played
+func emulate(t *testing.T, ctx context.Context, e *cardhopper.CardHopper, sim *Simulator) {
+	t.Helper()
+
+	ectx, stop := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- e.Emulate(ectx)
+	}()
+
+	require.NoError(t, sim.Wait(ctx))
+	stop()
+	require.NoError(t, <-done)
+}
+
+func TestFrameEmulator(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sim := New(Options{Script: []Step{
+		{Reader: unhex("3004"), Want: unhex("0430")},
+		{Reader: unhex("A2 05 01020304"), Want: unhex("04030201 05 A2")},
+	}})
+	defer sim.Close()
+
+	h := &frameRecorder{}
+	e := cardhopper.NewFrameEmulator(sim, h, cardhopper.Options{SetupOptions: fastSetup})
+	assert.ErrorIs(t, e.Setup(ctx), cardhopper.ErrFrameEmulator)
+	require.NoError(t, e.SetupTag(ctx, cardhopper.TagConfig{
+		Type: cardhopper.TagTypeMifareUltralight,
+		UID:  unhex("04112233445566"),
+	}))
+	assert.Equal(t, Config{
+		Type: cardhopper.TagTypeMifareUltralight,
+		FWI:  type4.DefaultFWI,
+		SFGI: type4.DefaultSFGI,
+		UID:  unhex("04112233445566"),
+	}, sim.Config())
+	assert.Equal(t, 1, h.resets)
+
+	emulate(t, ctx, e, sim)
+	require.NoError(t, e.Close())
+	require.NoError(t, sim.Err())
+	assert.Equal(t, [][]byte{unhex("3004"), unhex("A2 05 01020304")}, h.Frames())
+}
+
+func TestFrameEmulator_rats(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the device answers RATS itself so the reply of the handler is not sent
+	sim := New(Options{Script: []Step{
+		{Reader: unhex("E080"), Want: unhex("0578807002")},
+		{Reader: unhex("02 AA"), Want: unhex("AA 02")},
+	}})
+	defer sim.Close()
+
+	h := &frameRecorder{}
+	e := cardhopper.NewFrameEmulator(sim, h, cardhopper.Options{SetupOptions: fastSetup})
+	require.NoError(t, e.SetupTag(ctx, cardhopper.TagConfig{
+		Type: cardhopper.TagTypeISO14443_4,
+		UID:  unhex("04112233"),
+		ATS:  unhex("0578807002"),
+	}))
+
+	emulate(t, ctx, e, sim)
+	require.NoError(t, e.Close())
+	require.NoError(t, sim.Err())
+	assert.Equal(t, [][]byte{unhex("E080"), unhex("02 AA")}, h.Frames())
+}
+
+func TestCardHopper_SetupTag(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sim := New(Options{})
+	defer sim.Close()
+
+	// tag types are checked before anything is sent to the device
+	e := cardhopper.NewWithOptions(sim, TestCard(), cardhopper.Options{SetupOptions: fastSetup})
+	assert.Error(t, e.SetupTag(ctx, cardhopper.TagConfig{Type: cardhopper.TagTypeMifareUltralight, UID: unhex("04112233445566")}))
+	assert.Error(t, e.SetupTag(ctx, cardhopper.TagConfig{Type: 0, UID: unhex("04112233")}))
+	assert.Error(t, e.SetupTag(ctx, cardhopper.TagConfig{Type: cardhopper.TagTypeJavacard, UID: unhex("04112233"), ATS: unhex("05")}))
+	require.NoError(t, sim.Err())
+}
+
+func TestCardHopper_Emulate_withoutSetup(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sim := New(Options{Script: []Step{
+		{Reader: unhex("E080"), Want: unhex("0578807002")},
+		{Reader: unhex("02 00A4040000"), Want: unhex("02 00A4040000 9000")},
+	}})
+	defer sim.Close()
+
+	// the device was left in card mode by an earlier process
+	setup := pm3.CommandEnterStandalone.Bytes()
+	for _, p := range []cardhopper.Packet{cardhopper.MagicCard, {byte(cardhopper.TagTypeJavacard)}, {7, 0}, unhex("04112233"), unhex("0578807002")} {
+		setup = append(setup, p.Bytes()...)
+	}
+	_, err := sim.Write(setup)
+	require.NoError(t, err)
+	acks := make([]byte, 5)
+	_, err = io.ReadFull(sim, acks)
+	require.NoError(t, err)
+	assert.Equal(t, unhex("FEFEFEFEFE"), acks)
+
+	e := cardhopper.NewWithOptions(sim, TestCard(), cardhopper.Options{SetupOptions: fastSetup})
+	emulate(t, ctx, e, sim)
+	require.NoError(t, e.Close())
+	require.NoError(t, sim.Err())
+}
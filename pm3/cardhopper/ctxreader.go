@@ -0,0 +1,114 @@
+package cardhopper
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// idleBackoff is how long to wait before reading again after an empty read or io.EOF, which serial ports commonly
+// return on read timeouts
+const idleBackoff = 10 * time.Millisecond
+
+type readResult struct {
+	b   []byte
+	err error
+}
+
+// ctxReader makes reads from a port without read deadline support abandonable. Like rfid.Escapable a goroutine
+// performs the blocking read, but the data it reads after a read is abandoned is kept for the next read rather than
+// being lost. The context used for reads is set with setContext. ctxReader is not safe for concurrent use.
+type ctxReader struct {
+	src     io.Reader
+	results chan readResult
+	done    chan struct{}
+	started bool
+	buf     []byte
+	// err is a terminal error from the port
+	err error
+	ctx context.Context
+}
+
+func newCtxReader(src io.Reader) *ctxReader {
+	return &ctxReader{
+		src:     src,
+		results: make(chan readResult),
+		done:    make(chan struct{}),
+		ctx:     context.Background(),
+	}
+}
+
+func (r *ctxReader) setContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+func (r *ctxReader) pump() {
+	for {
+		b := make([]byte, 256)
+		n, err := r.src.Read(b)
+		select {
+		case r.results <- readResult{b: b[:n], err: err}:
+		case <-r.done:
+			return
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return
+		}
+		if n == 0 {
+			time.Sleep(idleBackoff)
+		}
+	}
+}
+
+func (r *ctxReader) Read(p []byte) (n int, err error) {
+	if len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if !r.started {
+			r.started = true
+			go r.pump()
+		}
+
+		select {
+		case res := <-r.results:
+			r.buf = res.b
+			err = res.err
+			if err != nil && !errors.Is(err, io.EOF) {
+				r.err = err
+			}
+		case <-r.ctx.Done():
+			return 0, context.Cause(r.ctx)
+		}
+	}
+
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, err
+}
+
+// close stops the read goroutine once any blocked read of the port returns, usually when the port is closed
+func (r *ctxReader) close() {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+}
+
+// discard drops any data already read from the port
+func (r *ctxReader) discard() {
+	r.buf = nil
+	for {
+		select {
+		case res := <-r.results:
+			if res.err != nil && !errors.Is(res.err, io.EOF) {
+				// keep the error for the next read
+				r.err = res.err
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package cardhopper
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCtxReader_cancel(t *testing.T) {
+	t.Parallel()
+
+	src, w := io.Pipe()
+	defer w.Close()
+	r := newCtxReader(src)
+	defer r.close()
+
+	// a read blocked on the port is abandoned when its context is cancelled
+	errStop := errors.New("stop")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	r.setContext(ctx)
+	read := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 4))
+		read <- err
+	}()
+	cancel(errStop)
+	select {
+	case err := <-read:
+		require.ErrorIs(t, err, errStop)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read not abandoned")
+	}
+
+	// data the port returns after the read was abandoned is kept for the next read
+	r.setContext(context.Background())
+	go func() {
+		_, _ = w.Write([]byte{0x01, 0x02, 0x03})
+	}()
+	b := make([]byte, 2)
+	n, err := r.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x01, 0x02}, b[:n])
+	n, err = r.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x03}, b[:n])
+}
+
+func TestCtxReader_err(t *testing.T) {
+	t.Parallel()
+
+	src, w := io.Pipe()
+	r := newCtxReader(src)
+	defer r.close()
+
+	// a port error is terminal
+	errPort := errors.New("port gone")
+	go func() {
+		_ = w.CloseWithError(errPort)
+	}()
+	_, err := r.Read(make([]byte, 1))
+	require.ErrorIs(t, err, errPort)
+	_, err = r.Read(make([]byte, 1))
+	require.ErrorIs(t, err, errPort)
+}
+
+func TestCtxReader_discard(t *testing.T) {
+	t.Parallel()
+
+	src, w := io.Pipe()
+	defer w.Close()
+	r := newCtxReader(src)
+	defer r.close()
+
+	go func() {
+		_, _ = w.Write([]byte{0x01, 0x02})
+	}()
+	b := make([]byte, 1)
+	_, err := r.Read(b)
+	require.NoError(t, err)
+
+	// the rest of the stale data is dropped
+	r.discard()
+	go func() {
+		_, _ = w.Write([]byte{0x03})
+	}()
+	n, err := r.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x03}, b[:n])
+}
@@ -9,6 +9,9 @@ import (
 	"io"
 )
 
+// maxPacketLen is the largest packet payload that can be represented by the single length byte
+const maxPacketLen = 255
+
 type Packet []byte
 
 var (
@@ -29,7 +32,7 @@ func (p *Packet) Bytes() []byte {
 
 func (p *Packet) WriteToIgnoreAck(writer io.Writer) (n int64, err error) {
 	defer rfid.DeferWrap(context.Background(), &err)
-	if len(*p) > 255 {
+	if len(*p) > maxPacketLen {
 		err = ErrPacketTooBig
 		return
 	}
@@ -99,7 +102,7 @@ func (p *Packet) ReadFrom(reader io.Reader) (n int64, err error) {
 }
 
 func (p *Packet) Write(b []byte) (n int, err error) {
-	if len(*p)+len(b) > 255 {
+	if len(*p)+len(b) > maxPacketLen {
 		err = ErrPacketTooBig
 		return
 	}
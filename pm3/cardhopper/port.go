@@ -0,0 +1,398 @@
+package cardhopper
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-rfid"
+	"github.com/nvx/go-rfid/pm3"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultStandaloneDelay = time.Second
+	DefaultAckTimeout      = 2 * time.Second
+	DefaultRetries         = 2
+	DefaultRestartDelay    = 100 * time.Millisecond
+
+	ack = 0xFE
+)
+
+var (
+	ErrAckTimeout = errors.New("timeout waiting for ACK")
+	ErrBadAck     = errors.New("bad ack")
+)
+
+// SetupOptions configures the handshake with the device, the zero value uses the defaults
+type SetupOptions struct {
+	// StandaloneDelay is how long to wait after entering standalone mode which is not acknowledged by the device,
+	// DefaultStandaloneDelay if zero
+	StandaloneDelay time.Duration
+	// StepDelay is an optional delay before each setup step for devices that need time between packets
+	StepDelay time.Duration
+	// AckTimeout is how long to wait for the device to acknowledge each packet, DefaultAckTimeout if zero
+	AckTimeout time.Duration
+	// Retries is the number of times the mode is restarted from mode selection and set up again if a setup packet was
+	// not acknowledged, DefaultRetries if zero. Negative disables retries.
+	Retries int
+	// RestartDelay is the delay between packets when closing, DefaultRestartDelay if zero
+	RestartDelay time.Duration
+	// Link is the connection to the device, the standalone command is sent with a CRC if the link requires one
+	Link pm3.Link
+}
+
+func (o SetupOptions) withDefaults() SetupOptions {
+	if o.StandaloneDelay == 0 {
+		o.StandaloneDelay = DefaultStandaloneDelay
+	}
+	if o.AckTimeout == 0 {
+		o.AckTimeout = DefaultAckTimeout
+	}
+	if o.Retries == 0 {
+		o.Retries = DefaultRetries
+	} else if o.Retries < 0 {
+		o.Retries = 0
+	}
+	if o.RestartDelay == 0 {
+		o.RestartDelay = DefaultRestartDelay
+	}
+	return o
+}
+
+// SetupError reports the setup stage that failed
+type SetupError struct {
+	Stage string
+	Err   error
+}
+
+func (e *SetupError) Error() string {
+	return "cardhopper setup failed at " + e.Stage + ": " + e.Err.Error()
+}
+
+func (e *SetupError) Unwrap() error {
+	return e.Err
+}
+
+// readDeadliner is implemented by ports such as net.Conn and *os.File that support read deadlines
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// port handles the serial framing shared by the card and reader modes of the CardHopper standalone firmware
+type port struct {
+	writer io.Writer
+	reader *bufio.Reader
+	// cr is set if the port does not support read deadlines
+	cr    *ctxReader
+	setup SetupOptions
+
+	// lastRead is the unix nano time of the last packet read from the device
+	lastRead atomic.Int64
+}
+
+func newPort(rw io.ReadWriter, setup SetupOptions) *port {
+	p := &port{
+		writer: rw,
+		setup:  setup.withDefaults(),
+	}
+
+	if _, ok := rw.(readDeadliner); ok {
+		p.reader = bufio.NewReader(rw)
+	} else {
+		p.cr = newCtxReader(rw)
+		p.reader = bufio.NewReader(p.cr)
+	}
+	p.lastRead.Store(time.Now().UnixNano())
+
+	return p
+}
+
+// LastRead returns when a packet was last read from the device, or when the port was created if none have been read
+func (p *port) LastRead() time.Time {
+	return time.Unix(0, p.lastRead.Load())
+}
+
+// withReadDeadline runs fn with reads that are abandoned after timeout or when ctx is cancelled. A timeout of zero
+// only abandons reads when ctx is cancelled. ErrAckTimeout is returned if the timeout is reached.
+func (p *port) withReadDeadline(ctx context.Context, timeout time.Duration, fn func() error) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	d, ok := p.writer.(readDeadliner)
+	if !ok {
+		rctx := ctx
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			rctx, cancel = context.WithTimeoutCause(ctx, timeout, ErrAckTimeout)
+			defer cancel()
+		}
+
+		p.cr.setContext(rctx)
+		defer p.cr.setContext(context.Background())
+
+		err = fn()
+		if ctx.Err() != nil {
+			err = context.Cause(ctx)
+		}
+		return
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+
+	err = d.SetReadDeadline(deadline)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = d.SetReadDeadline(time.Time{})
+	}()
+
+	stop := context.AfterFunc(ctx, func() {
+		// unblock the read immediately
+		_ = d.SetReadDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	err = fn()
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = ErrAckTimeout
+	}
+	return
+}
+
+// readAck waits for the device to acknowledge a packet
+func (p *port) readAck(ctx context.Context) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	return p.withReadDeadline(ctx, p.setup.AckTimeout, func() error {
+		b, err := p.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != ack {
+			return fmt.Errorf("%w: %02X", ErrBadAck, b)
+		}
+		return nil
+	})
+}
+
+func (p *port) write(ctx context.Context, packet Packet) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	_, err = packet.WriteToIgnoreAck(p.writer)
+	if err != nil {
+		return
+	}
+
+	return p.readAck(ctx)
+}
+
+// setupStep sends a setup packet after the step delay. Setup packets are positional so one that was not acknowledged
+// is never resent on its own, see selectMode.
+func (p *port) setupStep(ctx context.Context, stage string, packet Packet) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	err = sleep(ctx, p.setup.StepDelay)
+	if err == nil {
+		slog.DebugContext(ctx, "CardHopper setup", slog.String("stage", stage))
+		err = p.write(ctx, packet)
+	}
+	if err != nil {
+		err = &SetupError{Stage: stage, Err: err}
+		return
+	}
+	return nil
+}
+
+// selectMode selects the CardHopper mode with magic from mode selection then sends the setup packets of the mode with
+// steps, which may be nil. If a packet is not acknowledged in time the device may still have acted on it, so the mode
+// is restarted from mode selection and set up again.
+func (p *port) selectMode(ctx context.Context, magic Packet, steps func(ctx context.Context) error) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	for try := 0; ; try++ {
+		if try > 0 {
+			slog.WarnContext(ctx, "CardHopper setup not acknowledged, restarting mode", slog.Int("try", try))
+			err = p.restart(ctx)
+			if err != nil {
+				return
+			}
+		}
+
+		err = p.setupStep(ctx, "mode "+string(magic), magic)
+		if err == nil && steps != nil {
+			err = steps(ctx)
+		}
+		if err == nil || !errors.Is(err, ErrAckTimeout) || try >= p.setup.Retries {
+			return
+		}
+	}
+}
+
+// enterMode clears any stale input, enters standalone mode and selects the CardHopper mode with magic, see selectMode
+func (p *port) enterMode(ctx context.Context, magic Packet, steps func(ctx context.Context) error) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	if reset, ok := p.writer.(interface{ ResetInputBuffer() error }); ok {
+		slog.DebugContext(ctx, "Resetting port input buffer")
+		err = reset.ResetInputBuffer()
+		if err != nil {
+			err = &SetupError{Stage: "reset input buffer", Err: err}
+			return
+		}
+	}
+
+	p.discard(ctx)
+
+	slog.DebugContext(ctx, "Entering standalone mode")
+
+	if p.setup.Link.Framing().SendCRC {
+		_, err = pm3.CommandEnterStandalone.WriteToCRC(p.writer)
+	} else {
+		_, err = pm3.CommandEnterStandalone.WriteTo(p.writer)
+	}
+	if err != nil {
+		err = &SetupError{Stage: "enter standalone", Err: err}
+		return
+	}
+
+	// entering standalone mode is not acknowledged
+	err = sleep(ctx, p.setup.StandaloneDelay)
+	if err != nil {
+		err = &SetupError{Stage: "enter standalone", Err: err}
+		return
+	}
+
+	return p.selectMode(ctx, magic, steps)
+}
+
+// restartMode returns the device to mode selection without leaving standalone mode and selects the mode with magic,
+// see selectMode
+func (p *port) restartMode(ctx context.Context, magic Packet, steps func(ctx context.Context) error) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	err = p.restart(ctx)
+	if err != nil {
+		return
+	}
+
+	return p.selectMode(ctx, magic, steps)
+}
+
+// restart returns the device to mode selection, RESTART is ignored if it is already there
+func (p *port) restart(ctx context.Context) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	_, err = MagicRestart.WriteToIgnoreAck(p.writer)
+	if err != nil {
+		err = &SetupError{Stage: "restart", Err: err}
+		return
+	}
+
+	err = sleep(ctx, p.setup.RestartDelay)
+	if err != nil {
+		err = &SetupError{Stage: "restart", Err: err}
+		return
+	}
+
+	// drop any packet or late ACK the device sent before restarting
+	p.discard(ctx)
+	return nil
+}
+
+// close leaves the current CardHopper mode and standalone mode, the port cannot be read from afterwards
+func (p *port) close() (err error) {
+	defer rfid.DeferWrap(context.Background(), &err)
+
+	if p.cr != nil {
+		defer p.cr.close()
+	}
+
+	var errs []error
+	for _, packet := range []Packet{MagicRestart, MagicRestart, MagicEnd} {
+		_, werr := packet.WriteToIgnoreAck(p.writer)
+		if werr != nil {
+			errs = append(errs, fmt.Errorf("error writing %q: %w", []byte(packet), werr))
+		}
+		if !packet.Equal(MagicEnd) {
+			time.Sleep(p.setup.RestartDelay)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// discard drops any data already read from the device, used to resynchronise after an abandoned read
+func (p *port) discard(ctx context.Context) {
+	bufLen := p.reader.Buffered()
+	if bufLen > 0 {
+		slog.DebugContext(ctx, "Clearing read buffer")
+		_, _ = p.reader.Discard(bufLen)
+	}
+	if p.cr != nil {
+		p.cr.discard()
+	}
+}
+
+// read reads the next packet from the device, returning promptly if ctx is cancelled. A zero length packet may be
+// returned if the device sent one.
+func (p *port) read(ctx context.Context, packet *Packet) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	for {
+		var n int64
+		err = p.withReadDeadline(ctx, 0, func() (err error) {
+			n, err = packet.ReadFrom(p.reader)
+			return
+		})
+		if ctx.Err() != nil {
+			err = context.Cause(ctx)
+			return
+		}
+		if err == nil && n > 0 {
+			p.lastRead.Store(time.Now().UnixNano())
+			return nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			if n > 0 {
+				// a partial packet leaves the stream out of sync
+				p.discard(ctx)
+			}
+			return
+		}
+
+		// an empty read or io.EOF is commonly a read timeout on serial ports
+		err = sleep(ctx, idleBackoff)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return context.Cause(ctx)
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
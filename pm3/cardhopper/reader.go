@@ -0,0 +1,169 @@
+package cardhopper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-apdu"
+	"github.com/nvx/go-rfid"
+	"github.com/nvx/go-rfid/isodep"
+	"github.com/nvx/go-rfid/type4"
+	"io"
+	"log/slog"
+	"time"
+)
+
+var (
+	_ rfid.ExchangerAPDUer = (*Reader)(nil)
+	_ type4.Handler        = (*Reader)(nil)
+)
+
+var ErrNoCardResponse = errors.New("no response from card")
+
+// Reader drives a CardHopper device in reader mode, exchanging APDUs with a real card.
+// Once Setup the device selects a card and reports its UID, ATQA, SAK and ATS as consecutive packets, after which each
+// packet written is sent to the card as a frame and the card's response frame is returned as a packet. An empty
+// packet is returned if the card did not respond. ISO/IEC 14443-4 is handled on the host.
+type Reader struct {
+	*port
+	pcd      *isodep.PCD
+	identity *type4.Emulator
+}
+
+// ReaderOptions configures a Reader, the zero value is usable
+type ReaderOptions struct {
+	SetupOptions
+	PCD isodep.PCDOptions
+}
+
+func NewReader(port io.ReadWriter, opts ReaderOptions) *Reader {
+	r := &Reader{
+		port: newPort(port, opts.SetupOptions),
+	}
+	r.pcd = isodep.NewPCD(isodep.TransceiverFunc(r.transceive), opts.PCD)
+	return r
+}
+
+// Setup switches the device to reader mode and waits for a card, returning its identity.
+// The returned Emulator has no Handler set, when relaying the Reader itself can be used.
+func (r *Reader) Setup(ctx context.Context) (_ *type4.Emulator, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	err = r.enterMode(ctx, MagicRead, nil)
+	if err != nil {
+		return
+	}
+
+	return r.readIdentity(ctx)
+}
+
+func (r *Reader) readIdentity(ctx context.Context) (_ *type4.Emulator, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	slog.DebugContext(ctx, "Waiting for card")
+
+	var fields [4]Packet
+	for i := range fields {
+		err = r.read(ctx, &fields[i])
+		if err != nil {
+			return
+		}
+	}
+
+	uid, atqa, sak, atsBytes := fields[0], fields[1], fields[2], fields[3]
+	if len(sak) != 1 {
+		err = fmt.Errorf("bad SAK: %X", []byte(sak))
+		return
+	}
+
+	ats, err := type4.ParseATS(atsBytes)
+	if err != nil {
+		return
+	}
+
+	r.identity = &type4.Emulator{
+		UID:  uid,
+		SAK:  sak[0],
+		ATQA: atqa,
+		ATR:  ats.PCSCATR(),
+		ATS:  atsBytes,
+	}
+	// RATS has already been performed by the device
+	r.pcd.SetATS(ats)
+
+	slog.DebugContext(ctx, "Got card", rfid.LogHex("uid", uid), rfid.LogHex("atqa", atqa), rfid.LogHex("sak", sak), rfid.LogHex("ats", atsBytes))
+
+	return r.identity, nil
+}
+
+// Identity returns the identity of the card found during Setup
+func (r *Reader) Identity() *type4.Emulator {
+	return r.identity
+}
+
+// transceive implements isodep.Transceiver, timing is handled by the device so timeout is not used
+func (r *Reader) transceive(ctx context.Context, frame []byte, _ time.Duration) (_ []byte, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	err = r.write(ctx, frame)
+	if err != nil {
+		return
+	}
+
+	var resp Packet
+	err = r.read(ctx, &resp)
+	if err != nil {
+		return
+	}
+	if len(resp) == 0 {
+		err = ErrNoCardResponse
+		return
+	}
+
+	return resp, nil
+}
+
+func (r *Reader) Exchange(ctx context.Context, capdu []byte) ([]byte, error) {
+	return r.pcd.Exchange(ctx, capdu)
+}
+
+func (r *Reader) APDU(ctx context.Context, capdu apdu.Capdu) (apdu.Rapdu, error) {
+	return r.pcd.APDU(ctx, capdu)
+}
+
+// Reset deselects the card and selects it again, allowing the Reader to be used as the Handler of an emulator
+func (r *Reader) Reset(ctx context.Context) {
+	err := r.reselect(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to reselect card", rfid.ErrorAttrs(err))
+	}
+}
+
+func (r *Reader) reselect(ctx context.Context) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	err = r.pcd.Deselect(ctx)
+	if err != nil {
+		return
+	}
+
+	err = r.restartMode(ctx, MagicRead, nil)
+	if err != nil {
+		return
+	}
+
+	_, err = r.readIdentity(ctx)
+	return
+}
+
+func (r *Reader) Close() (err error) {
+	ctx := context.Background()
+	defer rfid.DeferWrap(ctx, &err)
+
+	err = r.pcd.Deselect(ctx)
+	if err != nil {
+		slog.DebugContext(ctx, "Failed to deselect card", rfid.ErrorAttrs(err))
+	}
+
+	return r.close()
+}
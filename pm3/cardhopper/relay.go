@@ -0,0 +1,495 @@
+package cardhopper
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-rfid"
+	"github.com/nvx/go-rfid/isodep"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// The relay protocol carries Packets over a stream such as TCP between a RelayServer and its peers, a RelayReader
+// driving a device in reader mode and a RelayCard driving a device in card mode.
+//
+// A peer starts by sending MagicRead or MagicCard. The server pairs a reader peer with a card peer, after which
+// every packet from one peer is forwarded to the other. The reader peer sends the UID, ATQA, SAK and ATS of the card
+// it found, then answers each frame received with the card's response. The card peer sends each frame received from
+// the reader and waits for the response.
+//
+// As with the device, the server acknowledges every packet a peer sends with a single 0xFE byte and packets sent to
+// a peer are not acknowledged. As a peer may receive a packet while waiting for an ACK, packets of 254 bytes are sent
+// with a length of 255 and a padding byte so a length is never mistaken for an ACK. Only ISO-DEP is relayed so packets
+// are never longer than 254 bytes. MagicRestart is forwarded to make the other peer start over from the identity, the
+// reader peer having lost the card or the card peer having been reset. MagicEnd is forwarded and ends the pair, as
+// does a peer disconnecting.
+
+const DefaultHelloTimeout = 10 * time.Second
+
+// paddedLen is the length sent on the relay for packets of 254 bytes, which are followed by a padding byte
+const paddedLen = 0xFF
+
+// relayBytes encodes a packet for the relay, padding it if its length would be mistaken for an ACK
+func relayBytes(packet Packet) ([]byte, error) {
+	switch {
+	case len(packet) > ack:
+		return nil, ErrPacketTooBig
+	case len(packet) == ack:
+		return append(append([]byte{paddedLen}, packet...), 0), nil
+	default:
+		return packet.Bytes(), nil
+	}
+}
+
+// unpadRelay removes the padding byte from a packet received from the relay
+func unpadRelay(packet Packet) Packet {
+	if len(packet) == paddedLen {
+		return packet[:ack]
+	}
+	return packet
+}
+
+var ErrBadHello = errors.New("expected READ or CARD")
+
+// RelayServerOptions configures a RelayServer, the zero value is usable
+type RelayServerOptions struct {
+	// HelloTimeout is how long a peer has to send its mode after connecting, DefaultHelloTimeout if zero
+	HelloTimeout time.Duration
+}
+
+// RelayStats is a snapshot of the frames relayed by a RelayServer
+type RelayStats struct {
+	Pairs  uint64
+	Frames uint64
+	// ReaderLatency is the time from a frame being forwarded to the reader peer until its response is received, this
+	// includes the network to the reader peer, the reader device and the card
+	ReaderLatency isodep.LatencyStats
+}
+
+// RelayServer pairs reader and card peers and forwards packets between them
+type RelayServer struct {
+	opts RelayServerOptions
+
+	mu      sync.Mutex
+	waiting map[string][]*relayPeer
+	stats   RelayStats
+}
+
+func NewRelayServer(opts RelayServerOptions) *RelayServer {
+	if opts.HelloTimeout == 0 {
+		opts.HelloTimeout = DefaultHelloTimeout
+	}
+
+	return &RelayServer{
+		opts:    opts,
+		waiting: make(map[string][]*relayPeer),
+	}
+}
+
+// Stats returns a snapshot of the frames relayed so far
+func (s *RelayServer) Stats() RelayStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
+
+// Serve accepts peers from ln until ctx is cancelled, ln is closed on return
+func (s *RelayServer) Serve(ctx context.Context, ln net.Listener) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = ln.Close()
+	})
+	defer stop()
+	defer ln.Close()
+
+	for {
+		var conn net.Conn
+		conn, err = ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return
+		}
+
+		go s.handle(ctx, conn)
+	}
+}
+
+// relayPeer is a connection to a peer, packets read from it are acknowledged and queued until forwarded
+type relayPeer struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	mode    string
+	packets chan Packet
+
+	writeMu sync.Mutex
+}
+
+func (p *relayPeer) writeRaw(b []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	_, err := p.conn.Write(b)
+	return err
+}
+
+func (p *relayPeer) send(packet Packet) error {
+	b, err := relayBytes(packet)
+	if err != nil {
+		return err
+	}
+	return p.writeRaw(b)
+}
+
+func (s *RelayServer) handle(ctx context.Context, conn net.Conn) {
+	addr := slog.String("peer", conn.RemoteAddr().String())
+
+	peer := &relayPeer{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		packets: make(chan Packet, 16),
+	}
+
+	// the connection is closed by the pair once paired, or by readLoop if the peer disconnects while waiting. The
+	// registration is released once readLoop ends so it does not outlive the peer.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+
+	err := s.hello(ctx, peer)
+	if err != nil {
+		slog.WarnContext(ctx, "Relay peer failed to connect", addr, rfid.ErrorAttrs(err))
+		stop()
+		_ = conn.Close()
+		return
+	}
+
+	slog.InfoContext(ctx, "Relay peer connected", addr, slog.String("mode", peer.mode))
+
+	go func() {
+		defer stop()
+		s.readLoop(ctx, peer)
+	}()
+
+	reader, card := s.pair(peer)
+	if reader != nil {
+		go s.relay(ctx, reader, card)
+	}
+}
+
+// hello reads the mode of a new peer
+func (s *RelayServer) hello(ctx context.Context, peer *relayPeer) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	err = peer.conn.SetReadDeadline(time.Now().Add(s.opts.HelloTimeout))
+	if err != nil {
+		return
+	}
+
+	var mode Packet
+	_, err = mode.ReadFrom(peer.reader)
+	if err != nil {
+		return
+	}
+
+	err = peer.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+	if !mode.Equal(MagicRead) && !mode.Equal(MagicCard) {
+		err = fmt.Errorf("%w: %q", ErrBadHello, []byte(mode))
+		return
+	}
+	peer.mode = string(mode)
+
+	return peer.writeRaw([]byte{ack})
+}
+
+// readLoop acknowledges and queues packets from the peer until the connection is closed
+func (s *RelayServer) readLoop(ctx context.Context, peer *relayPeer) {
+	defer func() {
+		close(peer.packets)
+		s.unwait(peer)
+	}()
+
+	for {
+		packet := make(Packet, 0, maxPacketLen)
+		_, err := packet.ReadFrom(peer.reader)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				slog.DebugContext(ctx, "Relay peer read failed", rfid.ErrorAttrs(err))
+			}
+			return
+		}
+
+		err = peer.writeRaw([]byte{ack})
+		if err != nil {
+			return
+		}
+
+		peer.packets <- unpadRelay(packet)
+	}
+}
+
+// pair returns a reader and card peer if peer completes a pair, otherwise peer waits for a partner
+func (s *RelayServer) pair(peer *relayPeer) (reader, card *relayPeer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	other := string(MagicCard)
+	if peer.mode == other {
+		other = string(MagicRead)
+	}
+
+	if len(s.waiting[other]) == 0 {
+		s.waiting[peer.mode] = append(s.waiting[peer.mode], peer)
+		return nil, nil
+	}
+
+	partner := s.waiting[other][0]
+	s.waiting[other] = s.waiting[other][1:]
+	s.stats.Pairs++
+
+	if peer.mode == string(MagicRead) {
+		return peer, partner
+	}
+	return partner, peer
+}
+
+// unwait removes a peer that disconnected before it was paired
+func (s *RelayServer) unwait(peer *relayPeer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	waiting := s.waiting[peer.mode]
+	for i, p := range waiting {
+		if p == peer {
+			s.waiting[peer.mode] = append(waiting[:i:i], waiting[i+1:]...)
+			_ = peer.conn.Close()
+			return
+		}
+	}
+}
+
+// relay forwards packets between a pair until either peer disconnects or sends MagicEnd
+func (s *RelayServer) relay(ctx context.Context, reader, card *relayPeer) {
+	addrs := []any{slog.String("reader", reader.conn.RemoteAddr().String()), slog.String("card", card.conn.RemoteAddr().String())}
+	slog.InfoContext(ctx, "Relay paired", addrs...)
+
+	var closeOnce sync.Once
+	closeAll := func() {
+		closeOnce.Do(func() {
+			_ = reader.conn.Close()
+			_ = card.conn.Close()
+		})
+	}
+	stop := context.AfterFunc(ctx, closeAll)
+	defer stop()
+
+	// forwarded is when the last frame was forwarded to the reader, zero if it has been answered
+	var mu sync.Mutex
+	var forwarded time.Time
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.forward(ctx, card, reader, closeAll, func(packet Packet) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			forwarded = time.Now()
+			s.mu.Lock()
+			s.stats.Frames++
+			s.mu.Unlock()
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		s.forward(ctx, reader, card, closeAll, func(packet Packet) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if forwarded.IsZero() {
+				// identity packets are not responses
+				return
+			}
+			latency := time.Since(forwarded)
+			forwarded = time.Time{}
+
+			s.mu.Lock()
+			s.stats.ReaderLatency.Add(latency)
+			s.mu.Unlock()
+		})
+	}()
+	wg.Wait()
+
+	slog.InfoContext(ctx, "Relay unpaired", addrs...)
+}
+
+// forward sends packets from src to dst, calling onData for each packet that is not MagicRestart or MagicEnd
+func (s *RelayServer) forward(ctx context.Context, src, dst *relayPeer, closeAll func(), onData func(Packet)) {
+	defer func() {
+		closeAll()
+		// readLoop of src ends once its connection is closed, it must not be left blocked on a full queue
+		for range src.packets {
+		}
+	}()
+
+	for packet := range src.packets {
+		if packet.Equal(MagicRestart) {
+			slog.DebugContext(ctx, "Relay restart", slog.String("from", src.mode))
+		} else if !packet.Equal(MagicEnd) {
+			onData(packet)
+		}
+
+		err := dst.send(packet)
+		if err != nil {
+			slog.DebugContext(ctx, "Relay peer write failed", rfid.ErrorAttrs(err))
+			return
+		}
+
+		if packet.Equal(MagicEnd) {
+			slog.DebugContext(ctx, "Relay end", slog.String("from", src.mode))
+			return
+		}
+	}
+
+	// src disconnected
+	err := dst.send(MagicEnd)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.DebugContext(ctx, "Failed to send end to relay peer", rfid.ErrorAttrs(err))
+	}
+}
+
+// relayConn is the peer side of a relay connection. A single goroutine reads the connection separating the ACKs for
+// packets sent from packets received.
+type relayConn struct {
+	conn       io.ReadWriteCloser
+	ackTimeout time.Duration
+
+	writeMu sync.Mutex
+	// expectAck counts packets sent that have not been acknowledged, a 0xFE byte where a packet would start is always
+	// an ACK as packets of 254 bytes are padded
+	expectAck int
+	ackMu     sync.Mutex
+	acks      chan struct{}
+
+	packets chan Packet
+	// err is the read error, valid once packets is closed
+	err error
+}
+
+func newRelayConn(conn io.ReadWriteCloser, ackTimeout time.Duration) *relayConn {
+	if ackTimeout == 0 {
+		ackTimeout = DefaultAckTimeout
+	}
+
+	c := &relayConn{
+		conn:       conn,
+		ackTimeout: ackTimeout,
+		acks:       make(chan struct{}, 16),
+		packets:    make(chan Packet, 16),
+	}
+	go c.pump()
+	return c
+}
+
+func (c *relayConn) pump() {
+	defer close(c.packets)
+
+	var lenBuf [1]byte
+	for {
+		_, err := io.ReadFull(c.conn, lenBuf[:])
+		if err != nil {
+			c.err = err
+			return
+		}
+
+		if lenBuf[0] == ack {
+			c.ackMu.Lock()
+			expected := c.expectAck > 0
+			if expected {
+				c.expectAck--
+			}
+			c.ackMu.Unlock()
+			if !expected {
+				slog.Debug("Ignoring unexpected ACK from relay")
+				continue
+			}
+			c.acks <- struct{}{}
+			continue
+		}
+
+		packet := make(Packet, lenBuf[0])
+		_, err = io.ReadFull(c.conn, packet)
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.packets <- unpadRelay(packet)
+	}
+}
+
+// send sends a packet and waits for the server to acknowledge it
+func (c *relayConn) send(ctx context.Context, packet Packet) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	b, err := relayBytes(packet)
+	if err != nil {
+		return
+	}
+
+	c.ackMu.Lock()
+	c.expectAck++
+	c.ackMu.Unlock()
+
+	_, err = c.conn.Write(b)
+	if err != nil {
+		return
+	}
+
+	t := time.NewTimer(c.ackTimeout)
+	defer t.Stop()
+
+	select {
+	case <-c.acks:
+		return nil
+	case <-t.C:
+		return ErrAckTimeout
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// recv returns the next packet from the server
+func (c *relayConn) recv(ctx context.Context) (_ Packet, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	select {
+	case packet, ok := <-c.packets:
+		if !ok {
+			err = fmt.Errorf("relay connection closed: %w", c.err)
+			return
+		}
+		return packet, nil
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+		return
+	}
+}
+
+func (c *relayConn) Close() error {
+	return c.conn.Close()
+}
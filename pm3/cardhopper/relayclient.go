@@ -0,0 +1,383 @@
+package cardhopper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-rfid"
+	"github.com/nvx/go-rfid/isodep"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	errRelayEnd     = errors.New("relay ended")
+	errRelayRestart = errors.New("relay restarted")
+	errRelayClosed  = errors.New("relay connection closed")
+)
+
+// endRelay tells the server the peer is leaving, used when ctx was cancelled
+func endRelay(ctx context.Context, c *relayConn) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+	defer cancel()
+
+	err := c.send(ctx, MagicEnd)
+	if err != nil {
+		slog.DebugContext(ctx, "Failed to send end to relay", rfid.ErrorAttrs(err))
+	}
+}
+
+// RelayReader connects a device in reader mode to a RelayServer, forwarding the frames of a RelayCard to the card
+type RelayReader struct {
+	reader *Reader
+
+	mu      sync.Mutex
+	latency isodep.LatencyStats
+}
+
+// NewRelayReader returns a RelayReader using the device on port. ISO-DEP options in opts are not used as frames are
+// relayed as is.
+func NewRelayReader(port io.ReadWriter, opts ReaderOptions) *RelayReader {
+	return &RelayReader{
+		reader: NewReader(port, opts),
+	}
+}
+
+// Stats returns the time taken by the device and card to answer each frame
+func (r *RelayReader) Stats() isodep.LatencyStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.latency
+}
+
+// Run relays over conn until ctx is cancelled or the pair ends, conn is closed on return
+func (r *RelayReader) Run(ctx context.Context, conn io.ReadWriteCloser) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	c := newRelayConn(conn, r.reader.setup.AckTimeout)
+	defer c.Close()
+
+	err = c.send(ctx, MagicRead)
+	if err != nil {
+		return
+	}
+
+	identity, err := r.reader.Setup(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		cerr := r.reader.close()
+		if cerr != nil {
+			slog.DebugContext(ctx, "Failed to close reader", rfid.ErrorAttrs(cerr))
+		}
+	}()
+
+	for {
+		for _, p := range []Packet{identity.UID, identity.ATQA, {identity.SAK}, identity.ATS} {
+			err = c.send(ctx, p)
+			if err != nil {
+				return
+			}
+		}
+
+		err = r.relayFrames(ctx, c)
+		if errors.Is(err, errRelayEnd) {
+			return nil
+		}
+		if ctx.Err() != nil {
+			endRelay(ctx, c)
+			return nil
+		}
+		if !errors.Is(err, errRelayRestart) {
+			return
+		}
+
+		slog.DebugContext(ctx, "Relay restarted, selecting card again")
+		err = r.reader.restartMode(ctx, MagicRead, nil)
+		if err != nil {
+			return
+		}
+		identity, err = r.reader.readIdentity(ctx)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// relayFrames sends frames from the relay to the card until MagicRestart or MagicEnd is received
+func (r *RelayReader) relayFrames(ctx context.Context, c *relayConn) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	for {
+		var frame Packet
+		frame, err = c.recv(ctx)
+		if err != nil {
+			return
+		}
+
+		switch {
+		case frame.Equal(MagicEnd):
+			return errRelayEnd
+		case frame.Equal(MagicRestart):
+			return errRelayRestart
+		}
+
+		start := time.Now()
+		var resp []byte
+		resp, err = r.reader.transceive(ctx, frame, 0)
+		if errors.Is(err, ErrNoCardResponse) {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		r.latency.Add(time.Since(start))
+		r.mu.Unlock()
+
+		err = c.send(ctx, resp)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// RelayCardOptions configures a RelayCard, the zero value is usable
+type RelayCardOptions struct {
+	Options
+
+	// TagType is the tag type emulated, TagTypeJavacard if zero. It must be an ISO-DEP tag type.
+	TagType TagType
+}
+
+// RelayCard connects a device in card mode to a RelayServer, emulating the card found by a RelayReader
+type RelayCard struct {
+	e    *CardHopper
+	opts RelayCardOptions
+
+	// responses receives frames from the relay while emulating
+	responses chan Packet
+	c         *relayConn
+
+	mu      sync.Mutex
+	latency isodep.LatencyStats
+}
+
+// NewRelayCard returns a RelayCard using the device on port
+func NewRelayCard(port io.ReadWriter, opts RelayCardOptions) *RelayCard {
+	if opts.TagType == 0 {
+		opts.TagType = TagTypeJavacard
+	}
+
+	rc := &RelayCard{
+		opts:      opts,
+		responses: make(chan Packet, 1),
+	}
+	rc.e = NewFrameEmulator(port, relayFrameHandler{rc}, opts.Options)
+	return rc
+}
+
+// Stats returns the time taken for each frame to be answered through the relay
+func (rc *RelayCard) Stats() isodep.LatencyStats {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.latency
+}
+
+// Run relays over conn until ctx is cancelled or the pair ends, conn is closed on return
+func (rc *RelayCard) Run(ctx context.Context, conn io.ReadWriteCloser) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	if !rc.opts.TagType.ISODEP() {
+		err = fmt.Errorf("tag type %s cannot be relayed", rc.opts.TagType)
+		return
+	}
+
+	rc.c = newRelayConn(conn, rc.e.setup.AckTimeout)
+	defer rc.c.Close()
+
+	err = rc.c.send(ctx, MagicCard)
+	if err != nil {
+		return
+	}
+
+	setup := false
+	defer func() {
+		if !setup {
+			return
+		}
+		cerr := rc.e.Close()
+		if cerr != nil {
+			slog.DebugContext(ctx, "Failed to close CardHopper", rfid.ErrorAttrs(cerr))
+		}
+	}()
+
+	for {
+		var tag TagConfig
+		tag, err = rc.readIdentity(ctx)
+		if errors.Is(err, errRelayEnd) {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				endRelay(ctx, rc.c)
+				return nil
+			}
+			return
+		}
+
+		if setup {
+			err = rc.e.restartTag(ctx, tag)
+		} else {
+			err = rc.e.SetupTag(ctx, tag)
+		}
+		if err != nil {
+			return
+		}
+		setup = true
+
+		err = rc.emulate(ctx)
+		if errors.Is(err, errRelayEnd) {
+			return nil
+		}
+		if ctx.Err() != nil {
+			endRelay(ctx, rc.c)
+			return nil
+		}
+		if !errors.Is(err, errRelayRestart) {
+			return
+		}
+		slog.DebugContext(ctx, "Relay restarted, waiting for card")
+	}
+}
+
+// readIdentity reads the card found by the reader peer, restarting if MagicRestart is received
+func (rc *RelayCard) readIdentity(ctx context.Context) (_ TagConfig, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	var fields [4]Packet
+	for i := 0; i < len(fields); i++ {
+		fields[i], err = rc.c.recv(ctx)
+		if err != nil {
+			return
+		}
+
+		switch {
+		case fields[i].Equal(MagicEnd):
+			err = errRelayEnd
+			return
+		case fields[i].Equal(MagicRestart):
+			i = -1
+		}
+	}
+
+	uid, ats := fields[0], fields[3]
+	slog.DebugContext(ctx, "Got relayed card", rfid.LogHex("uid", uid), rfid.LogHex("atqa", fields[1]), rfid.LogHex("sak", fields[2]), rfid.LogHex("ats", ats))
+
+	return TagConfig{
+		Type: rc.opts.TagType,
+		UID:  uid,
+		ATS:  ats,
+	}, nil
+}
+
+// emulate runs Emulate until the relay sends MagicRestart or MagicEnd, which are returned as errRelayRestart and
+// errRelayEnd
+func (rc *RelayCard) emulate(ctx context.Context) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	ectx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rc.dispatch(ectx, cancel)
+	}()
+
+	err = rc.e.Emulate(ectx)
+	cancel(nil)
+	wg.Wait()
+	if err != nil {
+		return
+	}
+
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return context.Cause(ectx)
+}
+
+// dispatch passes responses from the relay to HandleFrame, cancelling Emulate on MagicRestart or MagicEnd
+func (rc *RelayCard) dispatch(ctx context.Context, cancel context.CancelCauseFunc) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case packet, ok := <-rc.c.packets:
+			switch {
+			case !ok:
+				cancel(fmt.Errorf("%w: %w", errRelayClosed, rc.c.err))
+				return
+			case packet.Equal(MagicEnd):
+				cancel(errRelayEnd)
+				return
+			case packet.Equal(MagicRestart):
+				cancel(errRelayRestart)
+				return
+			}
+
+			select {
+			case rc.responses <- packet:
+			default:
+				slog.WarnContext(ctx, "Dropping unexpected relay packet", rfid.LogHex("packet", packet))
+			}
+		}
+	}
+}
+
+// relayFrameHandler sends frames received by the device through the relay
+type relayFrameHandler struct {
+	rc *RelayCard
+}
+
+func (h relayFrameHandler) HandleFrame(ctx context.Context, frame []byte) (_ []byte, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	if isodep.IsRATS(frame) {
+		// the device has already answered with the ATS of the relayed card
+		return nil, nil
+	}
+
+	// drop any response that arrived after its frame was abandoned
+	select {
+	case <-h.rc.responses:
+	default:
+	}
+
+	start := time.Now()
+	err = h.rc.c.send(ctx, frame)
+	if err != nil {
+		return
+	}
+
+	select {
+	case resp := <-h.rc.responses:
+		h.rc.mu.Lock()
+		h.rc.latency.Add(time.Since(start))
+		h.rc.mu.Unlock()
+		return resp, nil
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+		return
+	}
+}
+
+func (h relayFrameHandler) Reset(context.Context) {}
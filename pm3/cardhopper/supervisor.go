@@ -0,0 +1,268 @@
+package cardhopper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-rfid"
+	"github.com/nvx/go-rfid/isodep"
+	"github.com/nvx/go-rfid/type4"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMinBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+var ErrIdleTimeout = errors.New("no packets received from device")
+
+// DialFunc opens the port to the device, it is called again each time the link is lost
+type DialFunc func(ctx context.Context) (io.ReadWriteCloser, error)
+
+// SupervisorOptions configures a Supervisor, only Dial is required
+type SupervisorOptions struct {
+	Options
+
+	Dial DialFunc
+
+	// Configure is called with each new CardHopper before Setup. Each connection has a new CardHopper so emulators
+	// must be added here with AddEmulator, registrations made on an earlier CardHopper are not carried over.
+	Configure func(e *CardHopper) error
+
+	// MinBackoff and MaxBackoff bound the exponential delay between reconnection attempts, DefaultMinBackoff and
+	// DefaultMaxBackoff if zero
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// IdleTimeout treats the link as broken if no packets are received for the given duration, disabled if zero.
+	// A card that is not presented to a reader legitimately receives no packets so this should be generous.
+	IdleTimeout time.Duration
+
+	// OnConnected is called once the device is set up, attempt is the number of failed attempts since the last
+	// successful connection. e is only used until the link is lost, see Supervisor.SetEmulator to swap emulators.
+	OnConnected func(ctx context.Context, e *CardHopper, attempt int)
+	// OnDisconnected is called when the link is lost or an attempt to connect fails, before waiting backoff
+	OnDisconnected func(ctx context.Context, err error, attempt int, backoff time.Duration)
+}
+
+// Supervisor keeps a CardHopper emulating across device resets, re-enumeration and dropping out of standalone mode.
+// When the link breaks the port is closed and reopened with Dial, then set up again with exponential backoff.
+// The Supervisor owns the configuration of its CardHoppers: the emulator set with SetEmulator and the protocol counters
+// are kept across reconnections, anything else is applied to each CardHopper by Configure.
+type Supervisor struct {
+	opts  SupervisorOptions
+	stats *isodep.Stats
+
+	mu    sync.Mutex
+	type4 *type4.Emulator
+	// current is the CardHopper of the current connection, nil while not emulating
+	current *CardHopper
+}
+
+func NewSupervisor(type4Card *type4.Emulator, opts SupervisorOptions) *Supervisor {
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = DefaultMinBackoff
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+
+	return &Supervisor{
+		type4: type4Card,
+		opts:  opts,
+		stats: &isodep.Stats{},
+	}
+}
+
+// SetEmulator replaces the emulated card, see CardHopper.SetEmulator. The emulator is used for all later connections
+// even if the swap on the current connection fails, in which case the error is returned.
+func (s *Supervisor) SetEmulator(ctx context.Context, type4Card *type4.Emulator) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	err = type4Card.Validate()
+	if err != nil {
+		err = fmt.Errorf("invalid emulator: %w", err)
+		return
+	}
+
+	s.mu.Lock()
+	s.type4 = type4Card
+	e := s.current
+	s.mu.Unlock()
+
+	if e == nil {
+		return nil
+	}
+	return e.SetEmulator(ctx, type4Card)
+}
+
+// Stats returns a snapshot of the protocol counters of all connections, LastPacket and Emulating are those of the
+// current connection
+func (s *Supervisor) Stats() Stats {
+	s.mu.Lock()
+	e := s.current
+	s.mu.Unlock()
+
+	if e != nil {
+		// the counters are shared by all CardHoppers of the Supervisor
+		return e.Stats()
+	}
+	return Stats{StatsSnapshot: s.stats.Snapshot()}
+}
+
+// Run emulates until ctx is cancelled, recovering from link failures
+func (s *Supervisor) Run(ctx context.Context) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	attempt := 0
+	for {
+		var connected bool
+		connected, err = s.runOnce(ctx, attempt)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if connected {
+			attempt = 0
+		}
+		attempt++
+
+		backoff := s.backoff(attempt)
+		slog.WarnContext(ctx, "CardHopper link lost, reconnecting", rfid.ErrorAttrs(err), slog.Int("attempt", attempt), slog.Duration("backoff", backoff))
+		if s.opts.OnDisconnected != nil {
+			s.opts.OnDisconnected(ctx, err, attempt, backoff)
+		}
+
+		err = sleep(ctx, backoff)
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func (s *Supervisor) backoff(attempt int) time.Duration {
+	backoff := s.opts.MinBackoff
+	for i := 1; i < attempt && backoff < s.opts.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, s.opts.MaxBackoff)
+}
+
+// runOnce dials, sets up and emulates until the link breaks, returning whether setup succeeded
+func (s *Supervisor) runOnce(ctx context.Context, attempt int) (connected bool, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	rwc, err := s.opts.Dial(ctx)
+	if err != nil {
+		err = fmt.Errorf("error dialing device: %w", err)
+		return
+	}
+	defer func() {
+		cerr := rwc.Close()
+		if cerr != nil {
+			slog.DebugContext(ctx, "Failed to close port", rfid.ErrorAttrs(cerr))
+		}
+	}()
+
+	s.mu.Lock()
+	type4Card := s.type4
+	s.mu.Unlock()
+
+	e := newCardHopper(rwc, type4Card, s.opts.Options, s.stats)
+	if s.opts.Configure != nil {
+		err = s.opts.Configure(e)
+		if err != nil {
+			return
+		}
+	}
+
+	err = e.Setup(ctx)
+	if err != nil {
+		return
+	}
+	connected = true
+
+	s.mu.Lock()
+	s.current = e
+	latest := s.type4
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.current = nil
+		s.mu.Unlock()
+	}()
+
+	if latest != type4Card {
+		// SetEmulator was called during setup
+		err = e.SetEmulator(ctx, latest)
+		if err != nil {
+			closeCardHopper(ctx, e)
+			return
+		}
+	}
+
+	if attempt > 0 {
+		slog.InfoContext(ctx, "CardHopper link recovered", slog.Int("attempt", attempt))
+	}
+	if s.opts.OnConnected != nil {
+		s.opts.OnConnected(ctx, e, attempt)
+	}
+
+	ectx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	if s.opts.IdleTimeout > 0 {
+		go s.watchIdle(ectx, e, cancel)
+	}
+
+	err = e.Emulate(ectx)
+	if err == nil && ctx.Err() == nil {
+		// Emulate only returns nil when cancelled, so this was the idle watchdog
+		err = context.Cause(ectx)
+	}
+
+	closeCardHopper(ctx, e)
+
+	return
+}
+
+// closeCardHopper leaves standalone mode even if ctx was cancelled, giving up after a short timeout so a port that
+// does not accept the packets is still closed
+func closeCardHopper(ctx context.Context, e *CardHopper) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second+2*e.setup.RestartDelay)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- e.Close()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			slog.DebugContext(ctx, "Failed to close CardHopper", rfid.ErrorAttrs(err))
+		}
+	case <-ctx.Done():
+		slog.DebugContext(ctx, "Timed out closing CardHopper")
+	}
+}
+
+func (s *Supervisor) watchIdle(ctx context.Context, e *CardHopper, cancel context.CancelCauseFunc) {
+	t := time.NewTicker(max(min(s.opts.IdleTimeout/4, time.Second), time.Millisecond))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if time.Since(e.LastRead()) > s.opts.IdleTimeout {
+				cancel(ErrIdleTimeout)
+				return
+			}
+		}
+	}
+}
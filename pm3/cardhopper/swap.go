@@ -0,0 +1,156 @@
+package cardhopper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-rfid"
+	"github.com/nvx/go-rfid/type4"
+	"log/slog"
+)
+
+var (
+	// errSwap interrupts a read in Emulate to swap the emulator
+	errSwap = errors.New("emulator swap requested")
+	// errNotEmulating tells a waiting SetEmulator that Emulate returned before performing the swap
+	errNotEmulating = errors.New("not emulating")
+)
+
+type swapRequest struct {
+	type4 *type4.Emulator
+	done  chan error
+}
+
+// SetEmulator replaces the emulated card. The device is restarted into card mode with the new UID and ATS, and all
+// protocol state is reset so the next field activation sees the new identity. Emulators added with AddEmulator are
+// kept. SetEmulator is safe to call while Emulate is running, the swap then happens between frames and SetEmulator
+// waits for it to complete. If the swap fails Emulate returns the error.
+func (e *CardHopper) SetEmulator(ctx context.Context, type4Card *type4.Emulator) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	if e.router == nil {
+		err = ErrFrameEmulator
+		return
+	}
+
+	err = type4Card.Validate()
+	if err != nil {
+		err = fmt.Errorf("invalid emulator: %w", err)
+		return
+	}
+
+	e.swapMu.Lock()
+	defer e.swapMu.Unlock()
+
+	for {
+		e.mu.Lock()
+		if !e.emulating {
+			e.mu.Unlock()
+			// Emulate cannot start while swapMu is held so the device is not used concurrently
+			return e.swap(ctx, type4Card)
+		}
+
+		req := &swapRequest{
+			type4: type4Card,
+			done:  make(chan error, 1),
+		}
+		e.swapReq = req
+		if e.interrupt != nil {
+			e.interrupt(errSwap)
+		}
+		e.mu.Unlock()
+
+		select {
+		case err = <-req.done:
+			if errors.Is(err, errNotEmulating) {
+				continue
+			}
+			return
+		case <-ctx.Done():
+			e.mu.Lock()
+			if e.swapReq == req {
+				e.swapReq = nil
+			}
+			e.mu.Unlock()
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// swap restarts card mode with the new emulator, the caller must hold swapMu or be Emulate
+func (e *CardHopper) swap(ctx context.Context, type4Card *type4.Emulator) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	slog.InfoContext(ctx, "Swapping emulator", rfid.LogHex("uid", type4Card.UID), rfid.LogHex("ats", type4Card.ATS))
+
+	err = e.restartTag(ctx, TagConfig{
+		Type: TagTypeJavacard,
+		UID:  type4Card.UID,
+		ATS:  type4Card.ATS,
+	})
+	if err != nil {
+		return
+	}
+
+	// sessions of the replaced emulator end before it is dropped
+	e.router.Reset()
+	e.type4 = type4Card
+	e.router.SetFallback(e.newPICC(type4Card))
+
+	return nil
+}
+
+// startEmulating marks Emulate as running so swaps are handed to it, waiting for any swap in progress
+func (e *CardHopper) startEmulating() {
+	e.swapMu.Lock()
+	defer e.swapMu.Unlock()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.emulating = true
+}
+
+// stopEmulating hands any swap Emulate did not get to back to SetEmulator
+func (e *CardHopper) stopEmulating() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.emulating = false
+	e.interrupt = nil
+	if e.swapReq != nil {
+		e.swapReq.done <- errNotEmulating
+		e.swapReq = nil
+	}
+}
+
+// pendingSwap performs a swap requested while Emulate was running
+func (e *CardHopper) pendingSwap(ctx context.Context) error {
+	e.mu.Lock()
+	req := e.swapReq
+	e.swapReq = nil
+	e.mu.Unlock()
+
+	if req == nil {
+		return nil
+	}
+
+	err := e.swap(ctx, req.type4)
+	if err != nil && ctx.Err() != nil {
+		// Emulate is stopping, SetEmulator performs the swap itself with its own context
+		req.done <- errNotEmulating
+		return err
+	}
+	req.done <- err
+	return err
+}
+
+// setInterrupt sets the function cancelling the current read when a swap is requested, nil if not reading
+func (e *CardHopper) setInterrupt(cancel context.CancelCauseFunc) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.interrupt = cancel
+	if cancel != nil && e.swapReq != nil {
+		cancel(errSwap)
+	}
+}
@@ -0,0 +1,180 @@
+package cardhopper
+
+import (
+	"bytes"
+	"context"
+	"github.com/nvx/go-rfid/pm3"
+	"github.com/nvx/go-rfid/type4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// nopHandler answers every APDU with 9000. cardhoppertest cannot be imported here as it imports this package.
+type nopHandler struct{}
+
+func (nopHandler) Exchange(context.Context, []byte) ([]byte, error) {
+	return []byte{0x90, 0x00}, nil
+}
+
+func (nopHandler) Reset(context.Context) {}
+
+func testCard(uid byte) *type4.Emulator {
+	return &type4.Emulator{
+		UID:     []byte{0x04, 0x11, 0x22, uid},
+		SAK:     0x20,
+		ATQA:    []byte{0x04, 0x00},
+		ATS:     []byte{0x05, 0x78, 0x80, 0x70, 0x02},
+		Handler: nopHandler{},
+	}
+}
+
+// ackDevice acknowledges every packet the firmware acknowledges and records them, the reader never sends anything
+type ackDevice struct {
+	acks chan byte
+	done chan struct{}
+
+	mu      sync.Mutex
+	packets []Packet
+}
+
+func newAckDevice(t *testing.T) *ackDevice {
+	d := &ackDevice{
+		acks: make(chan byte, 1024),
+		done: make(chan struct{}),
+	}
+	t.Cleanup(func() {
+		close(d.done)
+	})
+	return d
+}
+
+func (d *ackDevice) Read(p []byte) (int, error) {
+	select {
+	case b := <-d.acks:
+		p[0] = b
+		return 1, nil
+	case <-d.done:
+		return 0, io.EOF
+	}
+}
+
+func (d *ackDevice) Write(p []byte) (int, error) {
+	if bytes.Equal(p, pm3.CommandEnterStandalone.Bytes()) {
+		return len(p), nil
+	}
+
+	packet := Packet(bytes.Clone(p[1:]))
+	d.mu.Lock()
+	d.packets = append(d.packets, packet)
+	d.mu.Unlock()
+
+	if !packet.Equal(MagicRestart) && !packet.Equal(MagicEnd) {
+		d.acks <- ack
+	}
+	return len(p), nil
+}
+
+// lastUID returns the UID of the last card mode set up
+func (d *ackDevice) lastUID() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i := len(d.packets) - 1; i >= 0; i-- {
+		// the mode is followed by the tag type, timing, UID and ATS
+		if d.packets[i].Equal(MagicCard) && i+3 < len(d.packets) {
+			return d.packets[i+3]
+		}
+	}
+	return nil
+}
+
+var fastSetup = SetupOptions{
+	StandaloneDelay: time.Millisecond,
+	RestartDelay:    time.Millisecond,
+}
+
+func TestCardHopper_SetEmulator_race(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dev := newAckDevice(t)
+	e := NewWithOptions(dev, testCard(0), Options{SetupOptions: fastSetup})
+	require.NoError(t, e.Setup(ctx))
+
+	// Emulate is repeatedly started and stopped so swaps are requested before, during and after it runs
+	stop := make(chan struct{})
+	emulated := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				emulated <- nil
+				return
+			default:
+			}
+
+			ectx, cancel := context.WithTimeout(ctx, time.Millisecond)
+			err := e.Emulate(ectx)
+			cancel()
+			if err != nil {
+				emulated <- err
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 10 {
+				assert.NoError(t, e.SetEmulator(ctx, testCard(byte(i*10+j))))
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	require.NoError(t, <-emulated)
+
+	e.swapMu.Lock()
+	uid := e.type4.UID
+	e.swapMu.Unlock()
+	assert.Equal(t, uid, []byte(dev.lastUID()))
+}
+
+func TestCardHopper_Setup_race(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dev := newAckDevice(t)
+	e := NewWithOptions(dev, testCard(0), Options{SetupOptions: fastSetup})
+	require.NoError(t, e.Setup(ctx))
+
+	// Setup reads the emulator replaced by SetEmulator
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for range 10 {
+			assert.NoError(t, e.Setup(ctx))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := range 10 {
+			assert.NoError(t, e.SetEmulator(ctx, testCard(byte(i))))
+		}
+	}()
+	wg.Wait()
+
+	assert.Equal(t, e.type4.UID, []byte(dev.lastUID()))
+}
@@ -0,0 +1,183 @@
+package cardhopper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-rfid"
+	"github.com/nvx/go-rfid/type4"
+	"io"
+	"log/slog"
+)
+
+var ErrFrameEmulator = errors.New("not supported by frame level emulator")
+
+// TagType is the tag type sent to the device in card mode. Values match the ISO/IEC 14443-A simulation tag types of
+// the pm3 firmware which determine the ATQA and SAK the device answers anticollision with.
+type TagType byte
+
+const (
+	TagTypeMifareClassic1K  TagType = 1
+	TagTypeMifareUltralight TagType = 2
+	TagTypeMifareDESFire    TagType = 3
+	TagTypeISO14443_4       TagType = 4
+	TagTypeMifareTnp3xxx    TagType = 5
+	TagTypeMifareMini       TagType = 6
+	TagTypeNTAG215          TagType = 7
+	TagTypeMifareClassic4K  TagType = 8
+	TagTypeFM11RF005SH      TagType = 9
+	TagTypeST25TA           TagType = 10
+	TagTypeJavacard         TagType = 11
+
+	tagTypeMax = TagTypeJavacard
+)
+
+func (t TagType) String() string {
+	switch t {
+	case TagTypeMifareClassic1K:
+		return "MIFARE Classic 1k"
+	case TagTypeMifareUltralight:
+		return "MIFARE Ultralight"
+	case TagTypeMifareDESFire:
+		return "MIFARE DESFire"
+	case TagTypeISO14443_4:
+		return "ISO/IEC 14443-4"
+	case TagTypeMifareTnp3xxx:
+		return "MIFARE Tnp3xxx"
+	case TagTypeMifareMini:
+		return "MIFARE Mini"
+	case TagTypeNTAG215:
+		return "NTAG215"
+	case TagTypeMifareClassic4K:
+		return "MIFARE Classic 4k"
+	case TagTypeFM11RF005SH:
+		return "FM11RF005SH"
+	case TagTypeST25TA:
+		return "ST25TA"
+	case TagTypeJavacard:
+		return "Javacard"
+	default:
+		return fmt.Sprintf("TagType(%d)", byte(t))
+	}
+}
+
+// Valid returns true if the tag type is known
+func (t TagType) Valid() bool {
+	return t >= TagTypeMifareClassic1K && t <= tagTypeMax
+}
+
+// ISODEP returns true if the tag type answers RATS and speaks ISO/IEC 14443-4
+func (t TagType) ISODEP() bool {
+	switch t {
+	case TagTypeMifareDESFire, TagTypeISO14443_4, TagTypeST25TA, TagTypeJavacard:
+		return true
+	default:
+		return false
+	}
+}
+
+// TagConfig is the identity configured on the device in card mode
+type TagConfig struct {
+	Type TagType
+	UID  []byte
+	// ATS including the TL byte, only used for ISO-DEP tag types. The FWI and SFGI sent to the device are derived from
+	// the ATS.
+	ATS []byte
+}
+
+// FrameHandler handles raw frames excluding the CRC for tags emulated at the frame level, typically those without
+// ISO-DEP. A nil response means no response is sent.
+type FrameHandler interface {
+	HandleFrame(ctx context.Context, frame []byte) ([]byte, error)
+	Reset(context.Context)
+}
+
+// NewFrameEmulator returns a CardHopper that passes every frame received to handler without ISO/IEC 14443-4
+// processing. SetupTag must be used instead of Setup. For ISO-DEP tag types RATS is passed to the handler but the ATS
+// is sent by the device.
+func NewFrameEmulator(port io.ReadWriter, handler FrameHandler, opts Options) *CardHopper {
+	return &CardHopper{
+		port:   newPort(port, opts.SetupOptions),
+		opts:   opts,
+		frames: handler,
+	}
+}
+
+// SetupTag switches the device to card mode emulating the given tag
+func (e *CardHopper) SetupTag(ctx context.Context, tag TagConfig) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	return e.setupTag(ctx, tag, e.enterMode)
+}
+
+// restartTag restarts card mode on a device that is already in card mode, emulating the given tag
+func (e *CardHopper) restartTag(ctx context.Context, tag TagConfig) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	return e.setupTag(ctx, tag, e.restartMode)
+}
+
+// setupTag configures the tag with enterMode, which is either enterMode or restartMode of the port
+func (e *CardHopper) setupTag(ctx context.Context, tag TagConfig, enterMode func(ctx context.Context, magic Packet, steps func(ctx context.Context) error) error) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	if !tag.Type.Valid() {
+		err = fmt.Errorf("unknown tag type %d", tag.Type)
+		return
+	}
+	if e.frames == nil && !tag.Type.ISODEP() {
+		err = fmt.Errorf("tag type %s requires a frame level emulator", tag.Type)
+		return
+	}
+
+	var timing Packet
+	var ats []byte
+	if tag.Type.ISODEP() {
+		// FWI and SFGI sent to the device must match what the ATS advertises to the reader
+		var parsed type4.ATS
+		parsed, err = type4.ParseATS(tag.ATS)
+		if err != nil {
+			return
+		}
+		timing = Packet{parsed.FWI, parsed.SFGI}
+		ats = tag.ATS
+	} else {
+		timing = Packet{type4.DefaultFWI, type4.DefaultSFGI}
+	}
+	if e.opts.Timing != nil {
+		timing = Packet{e.opts.Timing.FWI, e.opts.Timing.SFGI}
+	}
+
+	err = enterMode(ctx, MagicCard, func(ctx context.Context) (err error) {
+		slog.DebugContext(ctx, "Configuring tag", slog.String("type", tag.Type.String()), slog.Int("fwi", int(timing[0])), slog.Int("sfgi", int(timing[1])))
+
+		err = e.setupStep(ctx, "tag type", Packet{byte(tag.Type)})
+		if err != nil {
+			return
+		}
+
+		// Time Mode: FWI, SFGI
+		err = e.setupStep(ctx, "timing mode", timing)
+		if err != nil {
+			return
+		}
+
+		err = e.setupStep(ctx, "UID", tag.UID)
+		if err != nil {
+			return
+		}
+
+		// An empty ATS is sent for tag types without ISO-DEP
+		return e.setupStep(ctx, "ATS", ats)
+	})
+	if err != nil {
+		return
+	}
+
+	e.tagType = tag.Type
+	if e.frames != nil {
+		e.frames.Reset(ctx)
+	}
+
+	return nil
+}
@@ -1,274 +1,249 @@
 package cardhopper
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"github.com/nvx/go-rfid"
-	"github.com/nvx/go-rfid/pm3"
+	"github.com/nvx/go-rfid/isodep"
 	"github.com/nvx/go-rfid/type4"
 	"io"
 	"log/slog"
+	"sync"
 	"time"
 )
 
-type CardHopper struct {
-	writer io.Writer
-	reader *bufio.Reader
-
-	type4 *type4.Emulator
+// errWTXTimeout interrupts a read in Emulate when the reader's S(WTX) response is overdue
+var errWTXTimeout = errors.New("S(WTX) response timed out")
 
-	chainingBuf []byte
+// Timing is the FWI and SFGI sent to the device in card mode
+type Timing struct {
+	FWI  byte
+	SFGI byte
 }
 
-func New(port io.ReadWriter, type4Card *type4.Emulator) *CardHopper {
-	return &CardHopper{
-		writer: port,
-		reader: bufio.NewReader(port),
-		type4:  type4Card,
-	}
+// Options configures a CardHopper, the zero value is usable
+type Options struct {
+	SetupOptions
+
+	// Timing overrides the FWI and SFGI sent to the device which are otherwise derived from the ATS
+	Timing *Timing
+
+	// WTXM is the multiplier requested from the reader with S(WTX) while the emulator is processing an APDU.
+	// WTX is disabled if zero.
+	WTXM byte
+	// WTXAfter is how long to wait for the emulator before requesting a waiting time extension, defaults to half the
+	// FWT advertised in the ATS
+	WTXAfter time.Duration
+	// OnWTXUnsupported is called if the device does not forward the reader's S(WTX) response
+	OnWTXUnsupported func(ctx context.Context, err error)
+
+	// FrameTracer receives every frame exchanged with the reader except the RATS response sent by the device
+	FrameTracer isodep.FrameTracer
+
+	// OnSessionStart and OnSessionEnd report each field activation of the ISO-DEP emulators
+	OnSessionStart func(ctx context.Context, cid uint8)
+	OnSessionEnd   func(ctx context.Context, s isodep.Session)
 }
 
-func (e *CardHopper) Close() (err error) {
-	_, _ = MagicRestart.WriteToIgnoreAck(e.writer)
-	time.Sleep(100 * time.Millisecond)
-	_, _ = MagicRestart.WriteToIgnoreAck(e.writer)
-	time.Sleep(100 * time.Millisecond)
-	_, _ = MagicEnd.WriteToIgnoreAck(e.writer)
+// Stats is a snapshot of the protocol counters and the health of the link to the device
+type Stats struct {
+	isodep.StatsSnapshot
+	// LastPacket is when a packet was last received from the device
+	LastPacket time.Time
+	Emulating  bool
+}
 
-	return nil
+type CardHopper struct {
+	*port
+	opts Options
+
+	type4  *type4.Emulator
+	router *isodep.Router
+	stats  *isodep.Stats
+
+	// frames is set instead of type4 when emulating at the frame level
+	frames  FrameHandler
+	tagType TagType
+
+	// swapMu serialises SetEmulator and Setup and keeps Emulate from starting during a swap, mu guards the swap
+	// handoff to Emulate
+	swapMu    sync.Mutex
+	mu        sync.Mutex
+	emulating bool
+	interrupt context.CancelCauseFunc
+	swapReq   *swapRequest
 }
 
-func (e *CardHopper) write(ctx context.Context, packet Packet) (err error) {
-	defer rfid.DeferWrap(ctx, &err)
+func New(port io.ReadWriter, type4Card *type4.Emulator) *CardHopper {
+	return NewWithOptions(port, type4Card, Options{})
+}
 
-	_, err = packet.WriteTo(e.writer, e.reader)
-	return
+func NewWithOptions(port io.ReadWriter, type4Card *type4.Emulator, opts Options) *CardHopper {
+	return newCardHopper(port, type4Card, opts, &isodep.Stats{})
 }
 
-func (e *CardHopper) Setup(ctx context.Context) (err error) {
-	defer rfid.DeferWrap(ctx, &err)
+// newCardHopper returns a CardHopper counting into stats, which may be shared with earlier CardHoppers
+func newCardHopper(port io.ReadWriter, type4Card *type4.Emulator, opts Options, stats *isodep.Stats) *CardHopper {
+	e := &CardHopper{
+		port:  newPort(port, opts.SetupOptions),
+		opts:  opts,
+		type4: type4Card,
+		stats: stats,
+		// Emulate may be used on a device left in card mode without Setup, which always uses this type
+		tagType: TagTypeJavacard,
+	}
+	e.router = isodep.NewRouter(e.newPICC(type4Card))
+	e.router.SetStats(e.stats)
+	return e
+}
 
-	if reset, ok := e.writer.(interface{ ResetInputBuffer() error }); ok {
-		slog.DebugContext(ctx, "Resetting port input buffer")
-		err = reset.ResetInputBuffer()
-		if err != nil {
-			return
+func (e *CardHopper) newPICC(type4Card *type4.Emulator) *isodep.PICC {
+	wtxAfter := e.opts.WTXAfter
+	if wtxAfter == 0 {
+		fwi := byte(type4.DefaultFWI)
+		if ats, err := type4.ParseATS(type4Card.ATS); err == nil {
+			fwi = ats.FWI
 		}
+		wtxAfter = isodep.FWT(fwi) / 2
 	}
 
-	bufLen := e.reader.Buffered()
-	if bufLen > 0 {
-		slog.DebugContext(ctx, "Clearing read buffer")
-		_, _ = e.reader.Discard(bufLen)
-	}
+	return isodep.NewPICC(type4Card, isodep.PICCOptions{
+		// ATS is sent to the reader by the device
+		ATS:              nil,
+		MaxFrameSize:     maxPacketLen,
+		WTXM:             e.opts.WTXM,
+		WTXAfter:         wtxAfter,
+		OnWTXUnsupported: e.opts.OnWTXUnsupported,
+		Stats:            e.stats,
+		OnSessionStart:   e.opts.OnSessionStart,
+		OnSessionEnd:     e.opts.OnSessionEnd,
+	})
+}
 
-	slog.DebugContext(ctx, "Entering standalone mode")
+// AddEmulator registers an additional emulator activated by readers sending RATS with the given CID. Each emulator has
+// its own protocol state allowing a reader to talk to several cards at once. The emulator passed to New answers RATS
+// for any other CID. The UID and ATS sent to the reader are always those of the emulator passed to New.
+// AddEmulator must not be called while Emulate is running, see SetEmulator to replace the emulator passed to New.
+func (e *CardHopper) AddEmulator(cid uint8, type4Card *type4.Emulator) (err error) {
+	defer rfid.DeferWrap(context.Background(), &err)
 
-	_, err = pm3.CommandEnterStandalone.WriteTo(e.writer)
-	if err != nil {
-		err = fmt.Errorf("error entering standalone mode: %w", err)
+	if e.router == nil {
+		err = ErrFrameEmulator
 		return
 	}
 
-	time.Sleep(time.Second)
-
-	slog.DebugContext(ctx, "Switching CardHopper to card mode")
-	err = e.write(ctx, MagicCard)
-	if err != nil {
+	// the identity of added emulators is never sent to the reader, only the Handler and timing from the ATS are used
+	if type4Card == nil || type4Card.Handler == nil {
+		err = fmt.Errorf("emulator for CID %d has no Handler", cid)
 		return
 	}
+	if len(type4Card.ATS) > 0 {
+		_, err = type4.ParseATS(type4Card.ATS)
+		if err != nil {
+			err = fmt.Errorf("invalid ATS for CID %d: %w", cid, err)
+			return
+		}
+	}
 
-	time.Sleep(100 * time.Millisecond)
+	return e.router.Add(cid, e.newPICC(type4Card))
+}
 
-	slog.DebugContext(ctx, "Sending tag type")
-	// Tag Type 11 / 0x0B
-	err = e.write(ctx, Packet{11})
-	if err != nil {
-		return
+// Stats returns a snapshot of the protocol counters, it is safe to call while Emulate is running. The counters are
+// always zero for frame level emulators.
+func (e *CardHopper) Stats() Stats {
+	e.mu.Lock()
+	emulating := e.emulating
+	e.mu.Unlock()
+
+	return Stats{
+		StatsSnapshot: e.stats.Snapshot(),
+		LastPacket:    e.LastRead(),
+		Emulating:     emulating,
 	}
+}
 
-	time.Sleep(100 * time.Millisecond)
+func (e *CardHopper) Close() (err error) {
+	return e.close()
+}
 
-	slog.DebugContext(ctx, "Sending timing modes")
-	// Time Mode: FWI, SFGI
-	err = e.write(ctx, Packet{0x0E, 0x0B})
-	if err != nil {
-		return
-	}
+func (e *CardHopper) Setup(ctx context.Context) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
 
-	time.Sleep(100 * time.Millisecond)
+	// the emulator is replaced by swaps, which always happen while SetEmulator holds swapMu
+	e.swapMu.Lock()
+	defer e.swapMu.Unlock()
 
-	slog.DebugContext(ctx, "Sending UID")
-	// UID
-	err = e.write(ctx, e.type4.UID)
-	if err != nil {
+	if e.type4 == nil {
+		err = ErrFrameEmulator
 		return
 	}
 
-	time.Sleep(100 * time.Millisecond)
-
-	slog.DebugContext(ctx, "Sending ATS")
-	// ATS
-	err = e.write(ctx, e.type4.ATS)
+	err = e.type4.Validate()
 	if err != nil {
+		err = fmt.Errorf("invalid emulator: %w", err)
 		return
 	}
 
-	return nil
+	return e.SetupTag(ctx, TagConfig{
+		Type: TagTypeJavacard,
+		UID:  e.type4.UID,
+		ATS:  e.type4.ATS,
+	})
 }
 
+// Emulate processes frames from the reader until ctx is cancelled or an error occurs. Cancellation is noticed even
+// while waiting for the device. If cancelled while the device is waiting for a reply an empty reply is sent so the
+// device is left ready for Close or Setup.
 func (e *CardHopper) Emulate(ctx context.Context) (err error) {
 	defer rfid.DeferWrap(ctx, &err)
 
-	packet := make(Packet, 0, 255)
+	e.startEmulating()
+	defer e.stopEmulating()
+	if e.router != nil {
+		// the reader may not have finished with the card, any sessions in progress end with Emulate
+		defer e.router.Reset()
+	}
 
-	outPacket := make(Packet, 1, 255)
+	packet := make(Packet, 0, maxPacketLen)
 
-	var cid uint8 = 0xFF
-	for ctx.Err() == nil {
-		var n int64
-		n, err = packet.ReadFrom(e.reader)
+	for {
+		err = e.pendingSwap(ctx)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				continue
+			if ctx.Err() != nil {
+				return nil
 			}
 			return
 		}
-		if n == 0 {
-			continue
-		}
-
-		if len(packet) == 0 {
-			slog.WarnContext(ctx, "Got empty packet from cardhopper standalone!")
-			err = e.write(ctx, Packet{})
-			if err != nil {
-				return
-			}
-			continue
-		}
 
-		slog.DebugContext(ctx, "Got cardhopper packet", rfid.LogHex("packet", packet))
-
-		if packet[0] == 0xE0 && len(packet) == 2 {
-			cid = packet[1] & 0x0F
-			fsdi := packet[1] & 0xF0 >> 4
-			outPacket[0] |= 0x01 // set block number to 1
-			slog.DebugContext(ctx, "Got RATS", slog.Int("cid", int(cid)), slog.Int("fsdi", int(fsdi)))
-			// no need to reply to RATS
-			// err = e.write(ctx, Packet{})
-			//if err != nil {
-			//	return
-			//}
-			continue
-		}
-
-		pcb := packet[0]
-		hasCID := pcb&0x08 != 0
-
-		if hasCID && len(packet) >= 2 {
-			// has CID
-			if packet[1]&0x0F != cid {
-				slog.WarnContext(ctx, "Ignoring packet for other CID", slog.Int("cid", int(packet[1]&0x0F)), rfid.LogHex("packet", packet))
-				err = e.write(ctx, Packet{})
-				if err != nil {
-					return
-				}
-				continue
-			}
-		}
-
-		switch pcb & 0xC0 {
-		case 0x80: // R-Block
-			if pcb&0xE6 != 0xA2 {
-				slog.WarnContext(ctx, "R-Block with unexpected bits set", rfid.LogHex("packet", packet))
-			}
-			if pcb&0x01 == outPacket[0]&0x01 {
-				// Rule 11. When an R(ACK) or an R(NAK) block is received, if its block number is equal to the
-				// PICC’s current block number, the last block shall be re-transmitted.
-				slog.WarnContext(ctx, "R-Block triggering retransmit of last block", rfid.LogHex("packet", packet))
-				err = e.write(ctx, outPacket)
-				if err != nil {
-					return
-				}
-				continue
+		rctx, cancel := e.readContext(ctx)
+		e.setInterrupt(cancel)
+		err = e.read(rctx, &packet)
+		e.setInterrupt(nil)
+		cancel(nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
 			}
-
-			if pcb&0x10 == 0x10 {
-				// Rule 12. When an R(NAK) block is received, if its block number is not equal to the
-				// PICC’s current block number, an R(ACK) block shall be sent.
-				outPacket = outPacket[:len(packet)]
-				copy(outPacket, packet)
-
-				// Toggle block number
-				outPacket[0] ^= 0x01
-
-				err = e.write(ctx, outPacket)
-				if err != nil {
-					return
-				}
+			if errors.Is(context.Cause(rctx), errSwap) {
 				continue
 			}
-
-			slog.WarnContext(ctx, "Unexpected R-Block chaining ACK?", rfid.LogHex("packet", packet))
-			err = e.write(ctx, Packet{})
-			if err != nil {
-				return
-			}
-			continue
-		case 0xC0: // S-Block
-			if pcb&0xC7 != 0xC2 {
-				slog.WarnContext(ctx, "S-Block with unexpected bits set", rfid.LogHex("packet", packet))
-			}
-			if pcb&0x30 == 0 {
-				// DESELECT
-				slog.DebugContext(ctx, "DESELECT")
-				cid = 0xFF
-				e.type4.Reset(ctx)
-				// Send packet back to acknowledge
-				err = e.write(ctx, packet)
+			if errors.Is(context.Cause(rctx), errWTXTimeout) {
+				err = e.wtxTimeout(ctx)
 				if err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
 					return
 				}
 				continue
 			}
-
-			// WTX (not even forwarded by cardhopper) or RFU?
-			slog.WarnContext(ctx, "Ignoring unexpected S-Block", rfid.LogHex("packet", packet))
-			err = e.write(ctx, Packet{})
-			if err != nil {
-				return
-			}
-			continue
-
-		case 0x00: // I-Block
-			if pcb&0xE2 != 0x02 {
-				slog.WarnContext(ctx, "I-Block with unexpected bits set", rfid.LogHex("packet", packet))
-			}
-		default:
-			slog.WarnContext(ctx, "Bad PCB", rfid.LogHex("packet", packet))
-			err = e.write(ctx, Packet{})
-			if err != nil {
-				return
-			}
-			continue
-		}
-
-		hasNAD := pcb&0x04 != 0
-		chaining := pcb&0x10 != 0
-
-		headerLen := 1
-		if hasNAD {
-			headerLen++
-		}
-		if hasCID {
-			headerLen++
+			return
 		}
 
-		// Expect at least 1 INF byte after the header
-		if len(packet) < headerLen+1 {
-			slog.WarnContext(ctx, "Truncated packet?", rfid.LogHex("packet", packet))
+		if len(packet) == 0 {
+			slog.WarnContext(ctx, "Got empty packet from cardhopper standalone!")
 			err = e.write(ctx, Packet{})
 			if err != nil {
 				return
@@ -276,80 +251,105 @@ func (e *CardHopper) Emulate(ctx context.Context) (err error) {
 			continue
 		}
 
-		data := packet[headerLen:]
-
-		if chaining {
-			if hasNAD {
-				slog.WarnContext(ctx, "NAD not supported with chaining", rfid.LogHex("packet", packet))
-			}
-
-			e.chainingBuf = append(e.chainingBuf, data...)
-
-			// copy CID and block number flags from PCB for R(ACK)
-			packet[0] = 0xA2 | (pcb & 0x09)
-			if hasCID {
-				packet = packet[:2]
-			} else {
-				packet = packet[:1]
-			}
-
-			err = e.write(ctx, packet)
-			if err != nil {
-				return
+		slog.DebugContext(ctx, "Got cardhopper packet", rfid.LogHex("packet", packet))
+		e.trace(ctx, isodep.DirectionPCD, packet)
+
+		var reply []byte
+		if e.frames != nil {
+			reply, err = e.frames.HandleFrame(ctx, packet)
+			if err != nil && ctx.Err() == nil {
+				slog.WarnContext(ctx, "Failed to process frame", rfid.ErrorAttrs(err), rfid.LogHex("frame", packet))
+				reply, err = nil, nil
 			}
-			continue
-		} else if len(e.chainingBuf) > 0 {
-			data = append(e.chainingBuf, data...)
-			e.chainingBuf = nil
+		} else {
+			reply, err = e.router.Process(ctx, packet)
 		}
 
-		// Prepare reply
-		outPacket.Reset()
-		// Copy PCB [CID] [NAD] bytes
-		_, _ = outPacket.Write(packet[0:headerLen])
+		// no need to reply to RATS, the device has already sent the ATS
+		noReply := e.tagType.ISODEP() && isodep.IsRATS(packet)
 
-		var rapdu []byte
-		rapdu, err = e.type4.Exchange(ctx, data)
 		if err != nil {
 			if ctx.Err() != nil {
+				if !noReply {
+					e.abandonReply(ctx)
+				}
 				return nil
 			}
+			return
+		}
 
-			slog.WarnContext(ctx, "Failed to process APDU", rfid.ErrorAttrs(err), rfid.LogHex("apdu", data))
-
-			// 6F00 Internal Exception
-			err = e.sendReply(ctx, &outPacket, []byte{0x6F, 0x00})
-			if err != nil {
-				return
-			}
-
+		if noReply {
 			continue
 		}
 
-		err = e.sendReply(ctx, &outPacket, rapdu)
+		if len(reply) > 0 {
+			e.trace(ctx, isodep.DirectionPICC, reply)
+		}
+
+		// an empty packet is sent if there is no reply
+		err = e.write(ctx, reply)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			return
 		}
 	}
-
-	return nil
 }
 
-func (e *CardHopper) sendReply(ctx context.Context, packet *Packet, rapdu []byte) (err error) {
-	defer rfid.DeferWrap(ctx, &err)
+// readContext returns the context for reading the next packet, it expires with errWTXTimeout if an S(WTX) response
+// is expected from the reader
+func (e *CardHopper) readContext(ctx context.Context) (context.Context, context.CancelCauseFunc) {
+	if e.router == nil {
+		return context.WithCancelCause(ctx)
+	}
+
+	deadline := e.router.Deadline()
+	if deadline.IsZero() {
+		return context.WithCancelCause(ctx)
+	}
 
-	// TODO: Handle send chaining?
-	slog.DebugContext(ctx, "Sending rAPDU", rfid.LogHex("rapdu", rapdu))
+	dctx, stop := context.WithDeadlineCause(ctx, deadline, errWTXTimeout)
+	rctx, cancel := context.WithCancelCause(dctx)
+	return rctx, func(cause error) {
+		cancel(cause)
+		stop()
+	}
+}
 
-	_, err = packet.Write(rapdu)
-	if err != nil {
+// wtxTimeout sends the response to the last I-Block once the device failed to forward the reader's S(WTX) response
+func (e *CardHopper) wtxTimeout(ctx context.Context) (err error) {
+	reply, err := e.router.Timeout(ctx)
+	if err != nil || reply == nil {
 		return
 	}
 
-	err = e.write(ctx, *packet)
-	if err != nil {
+	e.trace(ctx, isodep.DirectionPICC, reply)
+	return e.write(ctx, reply)
+}
+
+func (e *CardHopper) trace(ctx context.Context, dir isodep.Direction, frame []byte) {
+	if e.opts.FrameTracer == nil {
 		return
 	}
 
-	return nil
+	f := isodep.Frame{
+		Time:      time.Now(),
+		Direction: dir,
+		Raw:       bytes.Clone(frame),
+	}
+	if e.frames == nil || e.tagType.ISODEP() {
+		f = isodep.NewFrame(f.Time, dir, f.Raw)
+	}
+
+	e.opts.FrameTracer.Frame(ctx, f)
+}
+
+// abandonReply sends an empty reply after ctx was cancelled while processing a frame so the device is not left waiting
+func (e *CardHopper) abandonReply(ctx context.Context) {
+	ctx = context.WithoutCancel(ctx)
+	err := e.write(ctx, Packet{})
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to send empty reply on shutdown", rfid.ErrorAttrs(err))
+	}
 }
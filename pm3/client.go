@@ -0,0 +1,278 @@
+package pm3
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-rfid"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// idleBackoff is how long to wait before reading again after an empty read or io.EOF, which serial ports commonly
+// return on read timeouts, see ClientOptions.Stream
+const idleBackoff = 10 * time.Millisecond
+
+var ErrClientClosed = errors.New("client closed")
+
+// ResponseHandler receives responses that are not waited for by a request. It is called from the read goroutine and
+// must not block or make requests.
+type ResponseHandler func(resp Response)
+
+// ClientOptions configures a Client, the zero value is suitable for USB
+type ClientOptions struct {
+	// Link selects the framing used by the Proxmark3 client on the link
+	Link Link
+	// Framing overrides the framing chosen by Link
+	Framing *Framing
+	// Old reads anything that is not an NG or MIX response as an OLD response, for firmware predating NG frames.
+	// Garbage on the link cannot be skipped when set.
+	Old bool
+	// Stream closes the Client when a read returns io.EOF, as on a closed TCP connection or pipe. It is implied if the
+	// link is a net.Conn. Otherwise io.EOF is treated as a read timeout, which some serial ports return.
+	Stream bool
+}
+
+type waiter struct {
+	command CommandID
+	ch      chan Response
+}
+
+// Client exchanges commands and responses with a Proxmark3. It is safe for concurrent use, requests waiting for the
+// same response command are answered in order.
+type Client struct {
+	rw      io.ReadWriter
+	framing Framing
+	old     bool
+	stream  bool
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	waiters  []*waiter
+	handlers map[CommandID]ResponseHandler
+	fallback ResponseHandler
+	closed   chan struct{}
+	err      error
+}
+
+// NewClient starts reading responses from rw, Close must be called to stop
+func NewClient(rw io.ReadWriter, opts ClientOptions) *Client {
+	framing := opts.Link.Framing()
+	if opts.Framing != nil {
+		framing = *opts.Framing
+	}
+
+	_, conn := rw.(net.Conn)
+
+	c := &Client{
+		rw:       rw,
+		framing:  framing,
+		old:      opts.Old,
+		stream:   opts.Stream || conn,
+		handlers: make(map[CommandID]ResponseHandler),
+		closed:   make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Handle routes responses with the given command that no request is waiting for to h, replacing any previous
+// handler. A nil h removes the handler.
+func (c *Client) Handle(command CommandID, h ResponseHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if h == nil {
+		delete(c.handlers, command)
+	} else {
+		c.handlers[command] = h
+	}
+}
+
+// HandleUnmatched routes responses without a waiting request or handler to h, by default they are logged
+func (c *Client) HandleUnmatched(h ResponseHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.fallback = h
+}
+
+// Send sends a command without waiting for a response, ErrBadLength is returned if the command data is too long
+func (c *Client) Send(ctx context.Context, cmd Frame) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	select {
+	case <-c.closed:
+		return c.closedErr()
+	default:
+	}
+
+	err = cmd.Validate()
+	if err != nil {
+		return
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	b := cmd.Bytes()
+	if c.framing.SendCRC {
+		b = cmd.BytesCRC()
+	}
+	_, err = c.rw.Write(b)
+	return
+}
+
+// Do sends a command and waits for the response with the same command
+func (c *Client) Do(ctx context.Context, cmd Frame) (Response, error) {
+	return c.DoExpect(ctx, cmd, cmd.CommandID())
+}
+
+// DoExpect sends a command and waits for the response with the given command, the response is returned even if its
+// status is an error, see Response.Err
+func (c *Client) DoExpect(ctx context.Context, cmd Frame, replyCommand CommandID) (_ Response, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	w := &waiter{
+		command: replyCommand,
+		ch:      make(chan Response, 1),
+	}
+
+	c.mu.Lock()
+	c.waiters = append(c.waiters, w)
+	c.mu.Unlock()
+	defer c.removeWaiter(w)
+
+	err = c.Send(ctx, cmd)
+	if err != nil {
+		return
+	}
+
+	select {
+	case resp := <-w.ch:
+		return resp, nil
+	case <-c.closed:
+		err = c.closedErr()
+		return
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+		return
+	}
+}
+
+func (c *Client) removeWaiter(w *waiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, other := range c.waiters {
+		if other == w {
+			c.waiters = append(c.waiters[:i:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Close stops the client, closing rw if it is an io.Closer. Pending requests fail with ErrClientClosed.
+// If rw is not an io.Closer a read in progress is not interrupted, the read goroutine exits once it returns.
+func (c *Client) Close() error {
+	c.shutdown(ErrClientClosed)
+
+	if closer, ok := c.rw.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *Client) shutdown(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+
+	c.err = err
+	close(c.closed)
+}
+
+func (c *Client) closedErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+func (c *Client) readLoop() {
+	ctx := context.Background()
+	r := bufio.NewReader(c.rw)
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+
+		resp, skipped, err := nextResponse(r, c.old)
+		if skipped > 0 {
+			slog.WarnContext(ctx, "Skipped bytes looking for response", slog.Int("skipped", skipped))
+		}
+		if err != nil {
+			// bufio gives up with io.ErrNoProgress after repeated empty reads from an idle port
+			if (errors.Is(err, io.EOF) && !c.stream) || errors.Is(err, io.ErrNoProgress) {
+				time.Sleep(idleBackoff)
+				continue
+			}
+			select {
+			case <-c.closed:
+				return
+			default:
+			}
+			if errors.Is(err, ErrDataTooLong) || errors.Is(err, ErrBadLength) {
+				slog.WarnContext(ctx, "Bad response", rfid.ErrorAttrs(err))
+				continue
+			}
+
+			c.shutdown(err)
+			return
+		}
+
+		if c.framing.VerifyCRC && !resp.ValidPostamble() {
+			slog.WarnContext(ctx, "Dropping corrupt response", rfid.ErrorAttrs(fmt.Errorf("%w: %04X", ErrBadPostamble, resp.Postamble)))
+			continue
+		}
+
+		c.dispatch(ctx, resp)
+	}
+}
+
+// dispatch passes a response to the oldest request waiting for it, or otherwise to its handler
+func (c *Client) dispatch(ctx context.Context, resp Response) {
+	c.mu.Lock()
+	for i, w := range c.waiters {
+		if w.command == resp.Command {
+			c.waiters = append(c.waiters[:i:i], c.waiters[i+1:]...)
+			c.mu.Unlock()
+			w.ch <- resp
+			return
+		}
+	}
+	h, ok := c.handlers[resp.Command]
+	if !ok {
+		h = c.fallback
+	}
+	c.mu.Unlock()
+
+	if h == nil {
+		slog.DebugContext(ctx, "Unhandled response", slog.Any("command", resp.Command), slog.Any("status", resp.Status), rfid.LogHex("data", resp.Data))
+		return
+	}
+	h(resp)
+}
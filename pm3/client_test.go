@@ -0,0 +1,219 @@
+package pm3
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readCommand reads an NG command frame written by the client
+func readCommand(r io.Reader) (cmd Command, postamble uint16, err error) {
+	var header [8]byte
+	_, err = io.ReadFull(r, header[:])
+	if err != nil {
+		return
+	}
+	if magic := binary.LittleEndian.Uint32(header[:]); magic != commandPreambleMagic {
+		err = fmt.Errorf("%w: %08X", ErrBadPreamble, magic)
+		return
+	}
+
+	lenNg := binary.LittleEndian.Uint16(header[4:])
+	cmd = Command{
+		NG:      lenNg&(1<<15) != 0,
+		Command: CommandID(binary.LittleEndian.Uint16(header[6:])),
+		Data:    make([]byte, lenNg&0x7FFF),
+	}
+	_, err = io.ReadFull(r, cmd.Data)
+	if err != nil {
+		return
+	}
+
+	var b [2]byte
+	_, err = io.ReadFull(r, b[:])
+	postamble = binary.LittleEndian.Uint16(b[:])
+	return
+}
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	host, device := net.Pipe()
+	c := NewClient(host, ClientOptions{Link: LinkUART})
+	defer c.Close()
+
+	debug := make(chan Response, 1)
+	c.Handle(CmdDebugPrintString, func(resp Response) {
+		select {
+		case debug <- resp:
+		default:
+		}
+	})
+
+	// the device echoes each command after some garbage, an unsolicited debug frame and a corrupt echo
+	go func() {
+		r := bufio.NewReader(device)
+		for {
+			cmd, postamble, err := readCommand(r)
+			if err != nil {
+				return
+			}
+			status := StatusSuccess
+			if b := cmd.BytesCRC(); postamble != binary.LittleEndian.Uint16(b[len(b)-2:]) {
+				status = StatusWrongAnswer
+			}
+
+			var out []byte
+			out = append(out, 0x00, 'P', 'M')
+			out = append(out, Response{NG: true, Command: 0x0100, Data: []byte("hi"), Postamble: responsePostambleMagic}.Bytes()...)
+			out = append(out, Response{NG: true, Command: cmd.Command, Data: []byte{0xFF, 0xFF}, Postamble: 0x1234}.Bytes()...)
+			out = append(out, Response{NG: true, Status: status, Command: cmd.Command, Data: cmd.Data}.WithCRC().Bytes()...)
+			_, err = device.Write(out)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := c.Do(ctx, Command{NG: true, Command: CmdPing, Data: []byte{byte(i)}})
+			if assert.NoError(t, err) {
+				assert.Equal(t, CmdPing, resp.Command)
+				assert.Len(t, resp.Data, 1)
+				assert.NoError(t, resp.Err())
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case resp := <-debug:
+		assert.Equal(t, []byte("hi"), resp.Data)
+	case <-ctx.Done():
+		t.Fatal("no debug frame")
+	}
+
+	require.NoError(t, c.Close())
+	_, err := c.Do(ctx, Command{NG: true, Command: CmdPing})
+	assert.ErrorIs(t, err, ErrClientClosed)
+}
+
+// emptyReader returns 0, nil for the first empty reads and whenever it has no data
+type emptyReader struct {
+	mu    sync.Mutex
+	empty int
+	data  []byte
+}
+
+func (r *emptyReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.empty > 0 {
+		r.empty--
+		return 0, nil
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *emptyReader) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestClient_emptyReads(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// more empty reads than bufio allows before io.ErrNoProgress
+	rw := &emptyReader{empty: 250}
+	c := NewClient(rw, ClientOptions{})
+	defer c.Close()
+
+	got := make(chan Response, 1)
+	c.Handle(CmdDebugPrintString, func(resp Response) {
+		got <- resp
+	})
+	rw.mu.Lock()
+	rw.data = Response{NG: true, Command: CmdDebugPrintString, Data: []byte("idle"), Postamble: responsePostambleMagic}.Bytes()
+	rw.mu.Unlock()
+
+	select {
+	case resp := <-got:
+		assert.Equal(t, []byte("idle"), resp.Data)
+	case <-ctx.Done():
+		t.Fatal("response not received", c.closedErr())
+	}
+}
+
+// pipeLink is a link that is not a net.Conn
+type pipeLink struct {
+	io.Reader
+	io.Writer
+}
+
+func TestClient_closedLink(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		link func() (host io.ReadWriter, device io.ReadWriteCloser)
+		opts ClientOptions
+	}{
+		{"net.Conn", func() (io.ReadWriter, io.ReadWriteCloser) {
+			return net.Pipe()
+		}, ClientOptions{}},
+		{"Stream", func() (io.ReadWriter, io.ReadWriteCloser) {
+			host, device := net.Pipe()
+			return pipeLink{Reader: host, Writer: host}, device
+		}, ClientOptions{Stream: true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			host, device := tt.link()
+			c := NewClient(host, tt.opts)
+			defer c.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := c.Do(ctx, Command{NG: true, Command: CmdPing})
+				done <- err
+			}()
+
+			// the device goes away after receiving the command without answering it
+			b := make([]byte, commandPreambleLen+postambleLen)
+			_, err := io.ReadFull(device, b)
+			require.NoError(t, err)
+			require.NoError(t, device.Close())
+
+			select {
+			case err = <-done:
+				require.ErrorIs(t, err, io.EOF)
+			case <-ctx.Done():
+				t.Fatal("pending request not failed")
+			}
+		})
+	}
+}
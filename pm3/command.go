@@ -11,30 +11,69 @@ import (
 const (
 	commandPreambleMagic  = uint32(0x61334D50) // PM3a
 	commandPostambleMagic = uint16(0x3361)     // a3
+
+	// commandPreambleLen is the size of the magic, length and command
+	commandPreambleLen = 4 + 2 + 2
 )
 
 var (
 	CommandEnterStandalone = Command{
 		NG:      true,
-		Command: 0x0115,
+		Command: CmdStandalone,
 		Data:    []byte{0x01},
 	}
 )
 
 type Command struct {
 	NG      bool
-	Command uint16
+	Command CommandID
 	Data    []byte
 }
 
+func (p Command) CommandID() CommandID {
+	return p.Command
+}
+
+func (p Command) Validate() error {
+	return checkDataLen(len(p.Data), MaxDataSize)
+}
+
 func (p Command) WriteTo(w io.Writer) (_ int64, err error) {
 	defer rfid.DeferWrap(context.Background(), &err)
 
+	err = p.Validate()
+	if err != nil {
+		return
+	}
+
 	n, err := w.Write(p.Bytes())
 	return int64(n), err
 }
 
+// WriteToCRC is like WriteTo but protects the frame with a CRC14A postamble
+func (p Command) WriteToCRC(w io.Writer) (_ int64, err error) {
+	defer rfid.DeferWrap(context.Background(), &err)
+
+	err = p.Validate()
+	if err != nil {
+		return
+	}
+
+	n, err := w.Write(p.BytesCRC())
+	return int64(n), err
+}
+
+// Bytes encodes the command with the a3 postamble, which is only accepted over USB
 func (p Command) Bytes() []byte {
+	return p.encode(false)
+}
+
+// BytesCRC encodes the command with a CRC14A postamble
+func (p Command) BytesCRC() []byte {
+	return p.encode(true)
+}
+
+func (p Command) encode(crc bool) []byte {
 	buf := new(bytes.Buffer)
 
 	err := binary.Write(buf, binary.LittleEndian, commandPreambleMagic)
@@ -42,6 +81,7 @@ func (p Command) Bytes() []byte {
 		panic(err)
 	}
 
+	// the length of an invalid frame is truncated, see Validate
 	lenNg := uint16(len(p.Data) & 0x7FFF)
 	if p.NG {
 		lenNg |= 1 << 15
@@ -61,7 +101,11 @@ func (p Command) Bytes() []byte {
 		panic(err)
 	}
 
-	err = binary.Write(buf, binary.LittleEndian, commandPostambleMagic)
+	postamble := commandPostambleMagic
+	if crc {
+		postamble = postambleCRC(buf.Bytes())
+	}
+	err = binary.Write(buf, binary.LittleEndian, postamble)
 	if err != nil {
 		panic(err)
 	}
@@ -3,6 +3,7 @@ package pm3
 import (
 	"bytes"
 	"encoding/hex"
+	"github.com/nvx/go-rfid/pm3/crc14a"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"strings"
@@ -17,4 +18,22 @@ func TestCommand_WriteTo(t *testing.T) {
 	require.NoError(t, err)
 	out := strings.ToUpper(hex.EncodeToString(buf.Bytes()))
 	assert.Equal(t, "504D336101801501016133", out)
+
+	buf.Reset()
+	_, err = Command{NG: true, Command: CmdPing, Data: make([]byte, MaxDataSize+1)}.WriteTo(&buf)
+	require.ErrorIs(t, err, ErrBadLength)
+	assert.Zero(t, buf.Len())
+}
+
+func TestCommand_BytesCRC(t *testing.T) {
+	t.Parallel()
+
+	b := CommandEnterStandalone.BytesCRC()
+	out := strings.ToUpper(hex.EncodeToString(b))
+	assert.Equal(t, "504D3361018015010137BA", out)
+
+	// the postamble is the CRC_14443_A of the frame sent high byte first
+	n := len(b)
+	reversed := append(bytes.Clone(b[:n-2]), b[n-1], b[n-2])
+	assert.True(t, crc14a.Valid(reversed))
 }
@@ -0,0 +1,79 @@
+package pm3
+
+import "fmt"
+
+// CommandID identifies a command and the responses to it
+type CommandID uint16
+
+const (
+	CmdDebugPrintString       CommandID = 0x0100
+	CmdDebugPrintIntegers     CommandID = 0x0101
+	CmdDebugPrintBytes        CommandID = 0x0102
+	CmdLCDReset               CommandID = 0x0103
+	CmdLCD                    CommandID = 0x0104
+	CmdBuffClear              CommandID = 0x0105
+	CmdReadMem                CommandID = 0x0106
+	CmdVersion                CommandID = 0x0107
+	CmdStatus                 CommandID = 0x0108
+	CmdPing                   CommandID = 0x0109
+	CmdDownloadEMLBigBuf      CommandID = 0x0110
+	CmdDownloadedEMLBigBuf    CommandID = 0x0111
+	CmdCapabilities           CommandID = 0x0112
+	CmdQuitSession            CommandID = 0x0113
+	CmdSetDbgMode             CommandID = 0x0114
+	CmdStandalone             CommandID = 0x0115
+	CmdWTX                    CommandID = 0x0116
+	CmdTIA                    CommandID = 0x0117
+	CmdBreakLoop              CommandID = 0x0118
+	CmdSetTearoff             CommandID = 0x0119
+	CmdGetDbgMode             CommandID = 0x0120
+	CmdHFISO14443AReader      CommandID = 0x0385
+	CmdMeasureAntennaTuning   CommandID = 0x0400
+	CmdMeasureAntennaTuningHF CommandID = 0x0401
+	CmdMeasureAntennaTuningLF CommandID = 0x0402
+	CmdHFDropField            CommandID = 0x0430
+
+	CmdAck     CommandID = 0x00FF
+	CmdNack    CommandID = 0x00FE
+	CmdUnknown CommandID = 0xFFFF
+)
+
+var commandNames = map[CommandID]string{
+	CmdDebugPrintString:       "DEBUG_PRINT_STRING",
+	CmdDebugPrintIntegers:     "DEBUG_PRINT_INTEGERS",
+	CmdDebugPrintBytes:        "DEBUG_PRINT_BYTES",
+	CmdLCDReset:               "LCD_RESET",
+	CmdLCD:                    "LCD",
+	CmdBuffClear:              "BUFF_CLEAR",
+	CmdReadMem:                "READ_MEM",
+	CmdVersion:                "VERSION",
+	CmdStatus:                 "STATUS",
+	CmdPing:                   "PING",
+	CmdDownloadEMLBigBuf:      "DOWNLOAD_EML_BIGBUF",
+	CmdDownloadedEMLBigBuf:    "DOWNLOADED_EML_BIGBUF",
+	CmdCapabilities:           "CAPABILITIES",
+	CmdQuitSession:            "QUIT_SESSION",
+	CmdSetDbgMode:             "SET_DBGMODE",
+	CmdStandalone:             "STANDALONE",
+	CmdWTX:                    "WTX",
+	CmdTIA:                    "TIA",
+	CmdBreakLoop:              "BREAK_LOOP",
+	CmdSetTearoff:             "SET_TEAROFF",
+	CmdGetDbgMode:             "GET_DBGMODE",
+	CmdHFISO14443AReader:      "HF_ISO14443A_READER",
+	CmdMeasureAntennaTuning:   "MEASURE_ANTENNA_TUNING",
+	CmdMeasureAntennaTuningHF: "MEASURE_ANTENNA_TUNING_HF",
+	CmdMeasureAntennaTuningLF: "MEASURE_ANTENNA_TUNING_LF",
+	CmdHFDropField:            "HF_DROPFIELD",
+	CmdAck:                    "ACK",
+	CmdNack:                   "NACK",
+	CmdUnknown:                "UNKNOWN",
+}
+
+func (c CommandID) String() string {
+	name, ok := commandNames[c]
+	if !ok {
+		return fmt.Sprintf("CMD_%04X", uint16(c))
+	}
+	return "CMD_" + name
+}
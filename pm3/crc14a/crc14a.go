@@ -0,0 +1,56 @@
+// Package crc14a implements the CRC_A of ISO/IEC 14443-3, which the Proxmark3 also uses to protect frames on links
+// that do not have their own integrity checks
+package crc14a
+
+import "encoding/binary"
+
+const (
+	// Init is the initial CRC value
+	Init = uint16(0x6363)
+
+	// poly is the reflected CCITT polynomial
+	poly = uint16(0x8408)
+)
+
+var table = makeTable()
+
+func makeTable() (t [256]uint16) {
+	for i := range t {
+		crc := uint16(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return
+}
+
+// Update returns crc updated with b
+func Update(crc uint16, b []byte) uint16 {
+	for _, v := range b {
+		crc = crc>>8 ^ table[byte(crc)^v]
+	}
+	return crc
+}
+
+// Checksum returns the CRC_A of b
+func Checksum(b []byte) uint16 {
+	return Update(Init, b)
+}
+
+// Append appends the CRC_A of b to b least significant byte first, as it is transmitted over the air
+func Append(b []byte) []byte {
+	return binary.LittleEndian.AppendUint16(b, Checksum(b))
+}
+
+// Valid reports if b ends with a correct CRC_A as added by Append
+func Valid(b []byte) bool {
+	if len(b) < 2 {
+		return false
+	}
+	return binary.LittleEndian.Uint16(b[len(b)-2:]) == Checksum(b[:len(b)-2])
+}
@@ -0,0 +1,38 @@
+package crc14a
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		in   string
+		want uint16
+	}{
+		{"", 0x6363},
+		{"0000", 0x1EA0},
+		{"1234", 0xCF26},
+		{"5000", 0xCD57},
+		{hex.EncodeToString([]byte("123456789")), 0xBF05},
+	} {
+		b, err := hex.DecodeString(tt.in)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tt.want, Checksum(b), tt.in)
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	t.Parallel()
+
+	// HLTA as sent by a reader
+	b := Append([]byte{0x50, 0x00})
+	assert.Equal(t, []byte{0x50, 0x00, 0x57, 0xCD}, b)
+	assert.True(t, Valid(b))
+	assert.False(t, Valid([]byte{0x50, 0x00, 0xCD, 0x57}))
+	assert.False(t, Valid([]byte{0x50}))
+}
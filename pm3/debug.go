@@ -0,0 +1,319 @@
+package pm3
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/nvx/go-rfid"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DebugLevel is the firmware debug level, which decides which debug messages it sends
+type DebugLevel uint8
+
+const (
+	DebugNone DebugLevel = iota
+	DebugError
+	DebugInfo
+	DebugDebug
+	DebugExtended
+)
+
+func (l DebugLevel) String() string {
+	switch l {
+	case DebugNone:
+		return "none"
+	case DebugError:
+		return "error"
+	case DebugInfo:
+		return "info"
+	case DebugDebug:
+		return "debug"
+	case DebugExtended:
+		return "extended"
+	default:
+		return fmt.Sprintf("DebugLevel(%d)", uint8(l))
+	}
+}
+
+// SlogLevel returns the level debug messages are logged at when the firmware is at l. Messages are sent without a
+// level so they are logged at the least severe level the firmware was configured to send.
+func (l DebugLevel) SlogLevel() slog.Level {
+	switch l {
+	case DebugError:
+		return slog.LevelError
+	case DebugNone, DebugInfo:
+		return slog.LevelInfo
+	case DebugDebug:
+		return slog.LevelDebug
+	default:
+		return slog.LevelDebug - 4
+	}
+}
+
+// SetDebugLevel sets the firmware debug level
+func (c *Client) SetDebugLevel(ctx context.Context, level DebugLevel) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	_, err = c.do(ctx, CmdSetDbgMode, []byte{byte(level)})
+	return
+}
+
+// DebugLevel returns the firmware debug level
+func (c *Client) DebugLevel(ctx context.Context) (_ DebugLevel, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	data, err := c.do(ctx, CmdGetDbgMode, nil)
+	if err != nil {
+		return
+	}
+	if len(data) < 1 {
+		err = fmt.Errorf("%w: debug level is empty", ErrBadLength)
+		return
+	}
+	return DebugLevel(data[0]), nil
+}
+
+// flags of CmdDebugPrintString
+const (
+	debugFlagLog     = 1 << 0
+	debugFlagInplace = 1 << 2
+)
+
+// DebugKind is the kind of a DebugEvent
+type DebugKind uint8
+
+const (
+	// DebugKindString is text printed by the firmware
+	DebugKindString DebugKind = iota
+	// DebugKindProgress is text meant to replace the previous progress text, such as a percentage
+	DebugKindProgress
+	DebugKindIntegers
+	DebugKindBytes
+	// DebugKindWTX is a request from the firmware for more time to answer the current command
+	DebugKindWTX
+)
+
+func (k DebugKind) String() string {
+	switch k {
+	case DebugKindString:
+		return "string"
+	case DebugKindProgress:
+		return "progress"
+	case DebugKindIntegers:
+		return "integers"
+	case DebugKindBytes:
+		return "bytes"
+	case DebugKindWTX:
+		return "WTX"
+	default:
+		return fmt.Sprintf("DebugKind(%d)", uint8(k))
+	}
+}
+
+// DebugEvent is a debug or progress message sent by the firmware
+type DebugEvent struct {
+	Time time.Time
+	Kind DebugKind
+	// Log is set for debug messages, which depend on the firmware debug level, rather than command output
+	Log bool
+	// Text is the text of string and progress messages with any ANSI escapes removed
+	Text     string
+	Integers [3]uint64
+	Bytes    []byte
+	WTX      time.Duration
+}
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*[A-Za-z]")
+
+// ParseDebugEvent decodes a CmdDebugPrintString, CmdDebugPrintIntegers, CmdDebugPrintBytes or CmdWTX response
+func ParseDebugEvent(resp Response) (_ DebugEvent, err error) {
+	defer rfid.DeferWrap(context.Background(), &err)
+
+	e := DebugEvent{Time: time.Now()}
+
+	switch resp.Command {
+	case CmdDebugPrintString:
+		var text []byte
+		if resp.NG {
+			if len(resp.Data) < 2 {
+				err = fmt.Errorf("%w: debug string is %d bytes", ErrBadLength, len(resp.Data))
+				return
+			}
+			flags := binary.LittleEndian.Uint16(resp.Data)
+			e.Log = flags&debugFlagLog != 0
+			if flags&debugFlagInplace != 0 {
+				e.Kind = DebugKindProgress
+			}
+			text = resp.Data[2:]
+		} else {
+			// MIX strings predate the flags and are always debug messages
+			e.Log = true
+			text = resp.Data[:min(resp.Args[0], uint64(len(resp.Data)))]
+		}
+		text, _, _ = bytes.Cut(text, []byte{0})
+		e.Text = ansiEscape.ReplaceAllString(string(text), "")
+	case CmdDebugPrintIntegers:
+		e.Kind = DebugKindIntegers
+		e.Log = true
+		e.Integers = resp.Args
+	case CmdDebugPrintBytes:
+		e.Kind = DebugKindBytes
+		e.Log = true
+		if resp.NG {
+			e.Bytes = resp.Data
+		} else {
+			e.Bytes = resp.Data[:min(resp.Args[0], uint64(len(resp.Data)))]
+		}
+	case CmdWTX:
+		if len(resp.Data) < 2 {
+			err = fmt.Errorf("%w: WTX is %d bytes", ErrBadLength, len(resp.Data))
+			return
+		}
+		e.Kind = DebugKindWTX
+		e.WTX = time.Duration(binary.LittleEndian.Uint16(resp.Data)) * time.Millisecond
+	default:
+		err = fmt.Errorf("%s is not a debug message", resp.Command)
+		return
+	}
+
+	return e, nil
+}
+
+// DebugOptions configures a DebugStream, the zero value is usable
+type DebugOptions struct {
+	// Logger receives the messages, slog.Default if nil
+	Logger *slog.Logger
+	// Level is the firmware debug level assumed until SetLevel is called
+	Level DebugLevel
+	// Buffer is the size of the Events channel, events are dropped if it is full. No events are sent if zero.
+	Buffer int
+}
+
+// DebugStream forwards debug and progress messages from the firmware to slog and a channel. It replaces any handlers
+// registered with Handle for the debug commands.
+type DebugStream struct {
+	c      *Client
+	logger *slog.Logger
+	level  atomic.Uint32
+
+	mu      sync.Mutex
+	events  chan DebugEvent
+	closed  bool
+	dropped int64
+}
+
+var debugCommands = []CommandID{CmdDebugPrintString, CmdDebugPrintIntegers, CmdDebugPrintBytes, CmdWTX}
+
+// NewDebugStream starts forwarding the debug messages received by c, Close must be called to stop
+func NewDebugStream(c *Client, opts DebugOptions) *DebugStream {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+
+	s := &DebugStream{
+		c:      c,
+		logger: opts.Logger,
+	}
+	s.level.Store(uint32(opts.Level))
+	if opts.Buffer > 0 {
+		s.events = make(chan DebugEvent, opts.Buffer)
+	}
+
+	for _, cmd := range debugCommands {
+		c.Handle(cmd, s.handle)
+	}
+	return s
+}
+
+// Events returns the channel of debug events, which is closed by Close. It is nil if DebugOptions.Buffer was zero.
+func (s *DebugStream) Events() <-chan DebugEvent {
+	return s.events
+}
+
+// Dropped returns how many events were dropped because the Events channel was full
+func (s *DebugStream) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dropped
+}
+
+// SetLevel sets the firmware debug level and logs later messages according to it
+func (s *DebugStream) SetLevel(ctx context.Context, level DebugLevel) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	err = s.c.SetDebugLevel(ctx, level)
+	if err != nil {
+		return
+	}
+
+	s.level.Store(uint32(level))
+	return nil
+}
+
+// Close stops forwarding messages and closes the Events channel
+func (s *DebugStream) Close() error {
+	for _, cmd := range debugCommands {
+		s.c.Handle(cmd, nil)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed && s.events != nil {
+		close(s.events)
+	}
+	s.closed = true
+	return nil
+}
+
+func (s *DebugStream) handle(resp Response) {
+	ctx := context.Background()
+
+	e, err := ParseDebugEvent(resp)
+	if err != nil {
+		slog.WarnContext(ctx, "Bad debug message", rfid.ErrorAttrs(err))
+		return
+	}
+
+	s.log(ctx, e)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.events == nil {
+		return
+	}
+	select {
+	case s.events <- e:
+	default:
+		s.dropped++
+	}
+}
+
+func (s *DebugStream) log(ctx context.Context, e DebugEvent) {
+	level := slog.LevelInfo
+	if e.Log {
+		level = DebugLevel(s.level.Load()).SlogLevel()
+	}
+
+	switch e.Kind {
+	case DebugKindString:
+		s.logger.Log(ctx, level, "Proxmark3 message", slog.String("text", strings.TrimSpace(e.Text)))
+	case DebugKindProgress:
+		s.logger.Log(ctx, slog.LevelDebug, "Proxmark3 progress", slog.String("text", strings.TrimSpace(e.Text)))
+	case DebugKindIntegers:
+		s.logger.Log(ctx, level, "Proxmark3 integers", slog.Any("integers", e.Integers))
+	case DebugKindBytes:
+		s.logger.Log(ctx, level, "Proxmark3 bytes", rfid.LogHex("bytes", e.Bytes))
+	case DebugKindWTX:
+		s.logger.Log(ctx, slog.LevelDebug, "Proxmark3 waiting time extension", slog.Duration("wtx", e.WTX))
+	}
+}
@@ -0,0 +1,91 @@
+package pm3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseDebugEvent(t *testing.T) {
+	t.Parallel()
+
+	e, err := ParseDebugEvent(Response{Command: CmdDebugPrintString, Args: [3]uint64{5}, Data: []byte("hello world")})
+	require.NoError(t, err)
+	assert.Equal(t, DebugKindString, e.Kind)
+	assert.True(t, e.Log)
+	assert.Equal(t, "hello", e.Text)
+
+	e, err = ParseDebugEvent(Response{NG: true, Command: CmdDebugPrintString, Data: append([]byte{debugFlagInplace | 8, 0x00}, "\x1b[33m50%\x1b[0m\x00"...)})
+	require.NoError(t, err)
+	assert.Equal(t, DebugKindProgress, e.Kind)
+	assert.False(t, e.Log)
+	assert.Equal(t, "50%", e.Text)
+
+	e, err = ParseDebugEvent(Response{NG: true, Command: CmdWTX, Data: []byte{0xE8, 0x03}})
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, e.WTX)
+
+	_, err = ParseDebugEvent(Response{NG: true, Command: CmdPing})
+	assert.Error(t, err)
+}
+
+func TestDebugStream(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	host, device := net.Pipe()
+	c := NewClient(host, ClientOptions{})
+	defer c.Close()
+
+	// the device prints a debug message and integers before acknowledging the new debug level
+	go func() {
+		r := bufio.NewReader(device)
+		for {
+			cmd, _, err := readCommand(r)
+			if err != nil {
+				return
+			}
+
+			var out []byte
+			out = append(out, Response{NG: true, Command: CmdDebugPrintString, Data: append([]byte{debugFlagLog, 0x00}, "field on"...), Postamble: responsePostambleMagic}.Bytes()...)
+			out = append(out, Response{Command: CmdDebugPrintIntegers, Args: [3]uint64{1, 2, 3}, Postamble: responsePostambleMagic}.Bytes()...)
+			out = append(out, Response{NG: true, Command: cmd.Command, Postamble: responsePostambleMagic}.Bytes()...)
+			_, err = device.Write(out)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var logs bytes.Buffer
+	s := NewDebugStream(c, DebugOptions{
+		Logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug - 4})),
+		Buffer: 1,
+	})
+
+	// messages are logged at the new level once it has been set
+	require.NoError(t, s.SetLevel(ctx, DebugError))
+	require.NoError(t, s.SetLevel(ctx, DebugError))
+
+	select {
+	case e := <-s.Events():
+		assert.Equal(t, "field on", e.Text)
+	case <-ctx.Done():
+		t.Fatal("no debug event")
+	}
+
+	require.NoError(t, s.Close())
+	_, ok := <-s.Events()
+	assert.False(t, ok)
+	assert.Equal(t, int64(3), s.Dropped())
+	assert.Contains(t, logs.String(), `level=ERROR msg="Proxmark3 message" text="field on"`)
+	assert.Contains(t, logs.String(), `msg="Proxmark3 integers"`)
+}
@@ -0,0 +1,50 @@
+package pm3
+
+import (
+	"github.com/nvx/go-rfid/pm3/crc14a"
+	"math/bits"
+)
+
+// Link is the kind of connection to the Proxmark3
+type Link uint8
+
+const (
+	// LinkUSB is the USB CDC serial port
+	LinkUSB Link = iota
+	// LinkUART is the FPC UART, including the Bluetooth add-on
+	LinkUART
+)
+
+func (l Link) String() string {
+	switch l {
+	case LinkUSB:
+		return "USB"
+	case LinkUART:
+		return "UART"
+	default:
+		return "unknown"
+	}
+}
+
+// Framing controls how frame postambles are protected
+type Framing struct {
+	// SendCRC sends commands with a CRC14A postamble instead of the a3 magic
+	SendCRC bool
+	// VerifyCRC drops responses whose postamble is neither the b3 magic nor a correct CRC14A
+	VerifyCRC bool
+}
+
+// Framing returns the framing used by the Proxmark3 client on the link. USB is trusted so commands are sent with the
+// magic, while the device requires a CRC on the UART. The client checks any response CRC regardless of link.
+func (l Link) Framing() Framing {
+	return Framing{
+		SendCRC:   l != LinkUSB,
+		VerifyCRC: true,
+	}
+}
+
+// postambleCRC returns the CRC14A of a frame as stored in its postamble, which places the first CRC byte in the high
+// byte of the little endian field
+func postambleCRC(frame []byte) uint16 {
+	return bits.ReverseBytes16(crc14a.Checksum(frame))
+}
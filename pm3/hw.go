@@ -0,0 +1,303 @@
+package pm3
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-rfid"
+	"io"
+)
+
+// CapabilitiesVersion is the version of the capabilities structure understood by this package, firmware reporting a
+// different version is incompatible
+const CapabilitiesVersion = 6
+
+// pingLen is the size of the echo data sent by Connect, the same as the Proxmark3 client
+const pingLen = 32
+
+var (
+	ErrPingMismatch = errors.New("ping echo mismatch")
+	ErrIncompatible = errors.New("incompatible firmware")
+)
+
+// Connect starts a Client on rw and checks the firmware can be used with it, the client is closed if it cannot
+func Connect(ctx context.Context, rw io.ReadWriter, opts ClientOptions) (_ *Client, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	c := NewClient(rw, opts)
+	defer func() {
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+
+	data := make([]byte, pingLen)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = c.Ping(ctx, data)
+	if err != nil {
+		return
+	}
+
+	_, err = c.Capabilities(ctx)
+	if err != nil {
+		return
+	}
+
+	return c, nil
+}
+
+// do sends an NG command and returns the data of a successful response
+func (c *Client) do(ctx context.Context, cmd CommandID, data []byte) ([]byte, error) {
+	resp, err := c.Do(ctx, Command{NG: true, Command: cmd, Data: data})
+	if err != nil {
+		return nil, err
+	}
+
+	err = resp.Err()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// Ping sends data to the device and checks it is echoed back
+func (c *Client) Ping(ctx context.Context, data []byte) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	echo, err := c.do(ctx, CmdPing, data)
+	if err != nil {
+		return
+	}
+
+	if !bytes.Equal(data, echo) {
+		err = fmt.Errorf("%w: sent %X, got %X", ErrPingMismatch, data, echo)
+		return
+	}
+	return nil
+}
+
+// Version is the firmware version reported by the device
+type Version struct {
+	// ChipID is the chip ID register of the AT91SAM7S
+	ChipID uint32
+	// SectionSize is the size of the firmware image in flash
+	SectionSize uint32
+	// Version is the version banner of the bootrom and OS
+	Version string
+}
+
+// FlashSize returns the size of the internal flash in bytes according to the chip ID
+func (v Version) FlashSize() int {
+	switch (v.ChipID >> 8) & 0xF {
+	case 1:
+		return 8 << 10
+	case 2:
+		return 16 << 10
+	case 3:
+		return 32 << 10
+	case 5:
+		return 64 << 10
+	case 7:
+		return 128 << 10
+	case 9:
+		return 256 << 10
+	case 10:
+		return 512 << 10
+	case 12:
+		return 1024 << 10
+	case 14:
+		return 2048 << 10
+	default:
+		return 0
+	}
+}
+
+// Version requests the firmware version
+func (c *Client) Version(ctx context.Context) (_ Version, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	data, err := c.do(ctx, CmdVersion, nil)
+	if err != nil {
+		return
+	}
+
+	if len(data) < 12 {
+		err = fmt.Errorf("%w: version is %d bytes", ErrBadLength, len(data))
+		return
+	}
+
+	v := Version{
+		ChipID:      binary.LittleEndian.Uint32(data[0:]),
+		SectionSize: binary.LittleEndian.Uint32(data[4:]),
+	}
+	versionLen := int(binary.LittleEndian.Uint32(data[8:]))
+	if versionLen > len(data)-12 {
+		err = fmt.Errorf("%w: version string is %d bytes but only %d were sent", ErrBadLength, versionLen, len(data)-12)
+		return
+	}
+	version, _, _ := bytes.Cut(data[12:12+versionLen], []byte{0})
+	v.Version = string(version)
+	return v, nil
+}
+
+// Status asks the device to print its status, which is sent as debug messages before the response. Use a DebugStream
+// to receive it.
+func (c *Client) Status(ctx context.Context) (err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	_, err = c.do(ctx, CmdStatus, nil)
+	return
+}
+
+// Capabilities are the features the firmware was compiled with and how it is connected
+type Capabilities struct {
+	Version    uint8
+	Baudrate   uint32
+	BigBufSize uint32
+
+	ViaFPC       bool
+	ViaUSBSerial bool
+
+	Flash        bool
+	Smartcard    bool
+	FPCUSART     bool
+	FPCUSARTDev  bool
+	FPCUSARTHost bool // Bluetooth add-on
+	LF           bool
+	Hitag        bool
+	EM4x50       bool
+	EM4x70       bool
+	ZX8211       bool
+	HFSniff      bool
+	HFPlot       bool
+	ISO14443A    bool
+	ISO14443B    bool
+	ISO15693     bool
+	FeliCa       bool
+	LegicRF      bool
+	IClass       bool
+	NFCBarcode   bool
+	LCD          bool
+
+	HasFlash     bool
+	HasSmartcard bool
+	IsRDV4       bool
+}
+
+// capabilitiesLen is the size of the version 6 structure, nine bytes of fields then 25 flags
+const capabilitiesLen = 9 + 4
+
+// ParseCapabilities decodes the capabilities structure, it fails with ErrIncompatible if the structure is not the
+// version understood by this package
+func ParseCapabilities(b []byte) (_ Capabilities, err error) {
+	defer rfid.DeferWrap(context.Background(), &err)
+
+	if len(b) < 1 {
+		err = fmt.Errorf("%w: capabilities are empty", ErrBadLength)
+		return
+	}
+	if b[0] != CapabilitiesVersion {
+		err = fmt.Errorf("%w: capabilities version %d, expected %d", ErrIncompatible, b[0], CapabilitiesVersion)
+		return
+	}
+	if len(b) != capabilitiesLen {
+		err = fmt.Errorf("%w: capabilities are %d bytes, expected %d", ErrIncompatible, len(b), capabilitiesLen)
+		return
+	}
+
+	flags := binary.LittleEndian.Uint32(b[9:])
+	flag := func(i int) bool {
+		return flags&(1<<i) != 0
+	}
+
+	return Capabilities{
+		Version:      b[0],
+		Baudrate:     binary.LittleEndian.Uint32(b[1:]),
+		BigBufSize:   binary.LittleEndian.Uint32(b[5:]),
+		ViaFPC:       flag(0),
+		ViaUSBSerial: flag(1),
+		Flash:        flag(2),
+		Smartcard:    flag(3),
+		FPCUSART:     flag(4),
+		FPCUSARTDev:  flag(5),
+		FPCUSARTHost: flag(6),
+		LF:           flag(7),
+		Hitag:        flag(8),
+		EM4x50:       flag(9),
+		EM4x70:       flag(10),
+		ZX8211:       flag(11),
+		HFSniff:      flag(12),
+		HFPlot:       flag(13),
+		ISO14443A:    flag(14),
+		ISO14443B:    flag(15),
+		ISO15693:     flag(16),
+		FeliCa:       flag(17),
+		LegicRF:      flag(18),
+		IClass:       flag(19),
+		NFCBarcode:   flag(20),
+		LCD:          flag(21),
+		HasFlash:     flag(22),
+		HasSmartcard: flag(23),
+		IsRDV4:       flag(24),
+	}, nil
+}
+
+// Capabilities requests the capabilities of the firmware, it fails with ErrIncompatible if the firmware does not
+// match this package
+func (c *Client) Capabilities(ctx context.Context) (_ Capabilities, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	data, err := c.do(ctx, CmdCapabilities, nil)
+	if err != nil {
+		return
+	}
+
+	return ParseCapabilities(data)
+}
+
+// AntennaTuning is the result of measuring the antennas, voltages are in mV
+type AntennaTuning struct {
+	LF134 uint32
+	LF125 uint32
+	// LFConfigured is the LF voltage at the configured divisor
+	LFConfigured uint32
+	HF           uint32
+	// LFPeak is the highest LF voltage, found at LFPeakDivisor
+	LFPeak        uint32
+	LFPeakDivisor uint32
+	// Divisor is the configured LF divisor
+	Divisor int32
+	// Results is the LF voltage sweep by divisor, scaled to fit a byte
+	Results [256]byte
+}
+
+// LFPeakFrequency returns the frequency of the highest LF voltage in kHz
+func (t AntennaTuning) LFPeakFrequency() float64 {
+	return 12000 / float64(t.LFPeakDivisor+1)
+}
+
+// Tune measures the antenna voltages, which takes a few seconds
+func (c *Client) Tune(ctx context.Context) (_ AntennaTuning, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	data, err := c.do(ctx, CmdMeasureAntennaTuning, nil)
+	if err != nil {
+		return
+	}
+
+	var t AntennaTuning
+	if len(data) != binary.Size(t) {
+		err = fmt.Errorf("%w: antenna tuning is %d bytes, expected %d", ErrBadLength, len(data), binary.Size(t))
+		return
+	}
+
+	err = binary.Read(bytes.NewReader(data), binary.LittleEndian, &t)
+	if err != nil {
+		return
+	}
+	return t, nil
+}
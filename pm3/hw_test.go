@@ -0,0 +1,153 @@
+package pm3
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeDevice answers commands sent over the returned connection with reply, responses without a command are sent as
+// NG responses to the command
+func fakeDevice(reply func(cmd Command) Response) net.Conn {
+	host, device := net.Pipe()
+
+	go func() {
+		defer device.Close()
+
+		r := bufio.NewReader(device)
+		for {
+			cmd, _, err := readCommand(r)
+			if err != nil {
+				return
+			}
+
+			resp := reply(cmd)
+			if resp.Command == 0 {
+				resp.NG = true
+				resp.Command = cmd.Command
+			}
+			resp.Postamble = responsePostambleMagic
+			_, err = device.Write(resp.Bytes())
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return host
+}
+
+func testCapabilities(version byte) []byte {
+	b := []byte{version}
+	b = binary.LittleEndian.AppendUint32(b, 115200)
+	b = binary.LittleEndian.AppendUint32(b, 40000)
+	// via USB, compiled with LF and ISO14443A, RDV4
+	return binary.LittleEndian.AppendUint32(b, 1<<1|1<<7|1<<14|1<<24)
+}
+
+func TestConnect(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name    string
+		echo    func(data []byte) []byte
+		version byte
+		err     error
+	}{
+		{"ok", func(data []byte) []byte { return data }, CapabilitiesVersion, nil},
+		{"bad echo", func(data []byte) []byte { return data[1:] }, CapabilitiesVersion, ErrPingMismatch},
+		{"old firmware", func(data []byte) []byte { return data }, CapabilitiesVersion - 1, ErrIncompatible},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn := fakeDevice(func(cmd Command) Response {
+				switch cmd.Command {
+				case CmdPing:
+					return Response{Data: tt.echo(cmd.Data)}
+				case CmdCapabilities:
+					return Response{Data: testCapabilities(tt.version)}
+				default:
+					return Response{Status: StatusNotImplemented}
+				}
+			})
+
+			c, err := Connect(ctx, conn, ClientOptions{})
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			defer c.Close()
+
+			caps, err := c.Capabilities(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, Capabilities{
+				Version:      CapabilitiesVersion,
+				Baudrate:     115200,
+				BigBufSize:   40000,
+				ViaUSBSerial: true,
+				LF:           true,
+				ISO14443A:    true,
+				IsRDV4:       true,
+			}, caps)
+
+			var statusErr *StatusError
+			err = c.Status(ctx)
+			require.ErrorAs(t, err, &statusErr)
+			assert.Equal(t, StatusNotImplemented, statusErr.Status)
+		})
+	}
+}
+
+func TestClient_Version(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	banner := "bootrom: master/v4.18994\x00"
+	c := NewClient(fakeDevice(func(cmd Command) Response {
+		b := binary.LittleEndian.AppendUint32(nil, 0x270B0A40)
+		b = binary.LittleEndian.AppendUint32(b, 290000)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(banner)))
+		return Response{Data: append(b, banner...)}
+	}), ClientOptions{})
+	defer c.Close()
+
+	v, err := c.Version(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, Version{ChipID: 0x270B0A40, SectionSize: 290000, Version: "bootrom: master/v4.18994"}, v)
+	assert.Equal(t, 512<<10, v.FlashSize())
+}
+
+func TestClient_Tune(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := NewClient(fakeDevice(func(cmd Command) Response {
+		var b []byte
+		for _, v := range []uint32{30000, 35000, 34000, 28000, 36000, 88} {
+			b = binary.LittleEndian.AppendUint32(b, v)
+		}
+		b = binary.LittleEndian.AppendUint32(b, 95)
+		return Response{Data: append(b, make([]byte, 256)...)}
+	}), ClientOptions{})
+	defer c.Close()
+
+	tuning, err := c.Tune(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(28000), tuning.HF)
+	assert.Equal(t, int32(95), tuning.Divisor)
+	assert.InDelta(t, 134.8, tuning.LFPeakFrequency(), 0.1)
+}
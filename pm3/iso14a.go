@@ -0,0 +1,278 @@
+package pm3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-apdu"
+	"github.com/nvx/go-rfid"
+	"github.com/nvx/go-rfid/type4"
+	"log/slog"
+	"time"
+)
+
+var (
+	_ rfid.ExchangerAPDUer = (*ISO14443AReader)(nil)
+)
+
+// flags of CmdHFISO14443AReader, passed in the first argument
+const (
+	iso14aConnect      = 1 << 0
+	iso14aNoDisconnect = 1 << 1
+	iso14aAPDU         = 1 << 2
+	iso14aRaw          = 1 << 3
+	iso14aAppendCRC    = 1 << 5
+	iso14aSetTimeout   = 1 << 6
+	iso14aNoSelect     = 1 << 7
+	iso14aSendChaining = 1 << 10
+)
+
+const (
+	// cardSelectLen is the size of iso14a_card_select_t, the UID, its length, ATQA, SAK, ATS length and ATS
+	cardSelectLen = 10 + 1 + 2 + 1 + 1 + 256
+
+	// maxFrameSize is the largest frame the firmware sends to the card
+	maxFrameSize = 256
+
+	// etusPerMillisecond converts raw timeouts to the ETUs of 128/fc used by the firmware
+	etusPerMillisecond = 13560000 / 1000 / 128
+
+	// pcbChaining is the chaining bit of the response PCB reported in the second argument of APDU responses
+	pcbChaining = 0x10
+)
+
+var (
+	ErrNoCard         = errors.New("no card")
+	ErrNoCardResponse = errors.New("no response from card")
+	ErrCardCRC        = errors.New("CRC error in response from card")
+	ErrBlockMismatch  = errors.New("block type mismatch in response from card")
+)
+
+// ISO14443AReader uses the Proxmark3 as an ISO/IEC 14443-A reader. ISO/IEC 14443-4 is handled by the firmware, APDUs
+// are sent with the field left on between them.
+type ISO14443AReader struct {
+	c        *Client
+	identity *type4.Emulator
+	// frameSize is the largest APDU chunk sent in one I-block
+	frameSize int
+}
+
+func NewISO14443AReader(c *Client) *ISO14443AReader {
+	return &ISO14443AReader{
+		c: c,
+	}
+}
+
+// transceive sends a CmdHFISO14443AReader command and waits for the ACK with its result
+func (r *ISO14443AReader) transceive(ctx context.Context, flags, arg1, arg2 uint64, data []byte) (_ Response, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	resp, err := r.c.DoExpect(ctx, MixCommand{
+		Command: CmdHFISO14443AReader,
+		Args:    [3]uint64{flags, arg1, arg2},
+		Data:    data,
+	}, CmdAck)
+	if err != nil {
+		return
+	}
+
+	err = resp.Err()
+	if err != nil {
+		return
+	}
+	return resp, nil
+}
+
+// Connect powers the field and selects a card, returning its identity. The returned Emulator has no Handler set, the
+// ATS and ATR are empty if the card does not support ISO/IEC 14443-4.
+func (r *ISO14443AReader) Connect(ctx context.Context) (_ *type4.Emulator, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	resp, err := r.transceive(ctx, iso14aConnect|iso14aNoDisconnect, 0, 0, nil)
+	if err != nil {
+		return
+	}
+	if resp.Args[0] == 0 {
+		err = ErrNoCard
+		return
+	}
+	if len(resp.Data) < cardSelectLen {
+		err = fmt.Errorf("%w: card select is %d bytes", ErrBadLength, len(resp.Data))
+		return
+	}
+
+	uidLen := min(int(resp.Data[10]), 10)
+	identity := &type4.Emulator{
+		UID:  append([]byte(nil), resp.Data[:uidLen]...),
+		ATQA: append([]byte(nil), resp.Data[11:13]...),
+		SAK:  resp.Data[13],
+	}
+
+	r.frameSize = maxFrameSize
+	atsLen := int(resp.Data[14])
+	// the ATS is reported with its CRC, TL is the length without it. TL includes itself so a TL of 0 is no ATS.
+	if ats := resp.Data[15 : 15+atsLen]; atsLen > 0 && ats[0] > 0 && int(ats[0]) <= atsLen {
+		identity.ATS = append([]byte(nil), ats[:ats[0]]...)
+
+		var parsed type4.ATS
+		parsed, err = type4.ParseATS(identity.ATS)
+		if err != nil {
+			return
+		}
+		identity.ATR = parsed.PCSCATR()
+		r.frameSize = min(parsed.FSC(), maxFrameSize)
+	}
+
+	r.identity = identity
+
+	slog.DebugContext(ctx, "Got card", rfid.LogHex("uid", identity.UID), rfid.LogHex("atqa", identity.ATQA), slog.Int("sak", int(identity.SAK)), rfid.LogHex("ats", identity.ATS))
+
+	return identity, nil
+}
+
+// Identity returns the identity of the card found by Connect
+func (r *ISO14443AReader) Identity() *type4.Emulator {
+	return r.identity
+}
+
+// exchangeBlock sends one I-block and returns its response and if the card chained it
+func (r *ISO14443AReader) exchangeBlock(ctx context.Context, data []byte, chaining bool) (_ []byte, chained bool, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	flags := uint64(iso14aAPDU | iso14aNoDisconnect)
+	if chaining {
+		flags |= iso14aSendChaining
+	}
+
+	resp, err := r.transceive(ctx, flags, uint64(len(data)), 0, data)
+	if err != nil {
+		return
+	}
+
+	// the length includes the CRC, negative values are errors sent as a 32-bit int
+	respLen := int64(int32(resp.Args[0]))
+	switch {
+	case respLen == 0:
+		err = ErrNoCardResponse
+		return
+	case respLen == -1:
+		err = ErrCardCRC
+		return
+	case respLen == -2:
+		err = ErrBlockMismatch
+		return
+	case respLen < 0 || respLen-2 > int64(len(resp.Data)):
+		err = fmt.Errorf("bad response length %d", respLen)
+		return
+	}
+
+	chained = resp.Args[1]&pcbChaining != 0
+	return resp.Data[:max(respLen-2, 0)], chained, nil
+}
+
+// Exchange sends an APDU to the card, chaining it if it does not fit in a frame
+func (r *ISO14443AReader) Exchange(ctx context.Context, capdu []byte) (_ []byte, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	if r.identity == nil {
+		err = errors.New("not connected")
+		return
+	}
+
+	// each block carries a PCB and CRC
+	chunkSize := min(r.frameSize-3, MaxMixDataSize)
+
+	var rapdu []byte
+	chained := false
+	for sent := 0; sent == 0 || sent < len(capdu); {
+		chunk := capdu[sent:min(sent+chunkSize, len(capdu))]
+		sent += len(chunk)
+		last := sent >= len(capdu)
+
+		var resp []byte
+		// chained blocks are answered with an R(ACK), which is reported as an empty response
+		resp, chained, err = r.exchangeBlock(ctx, chunk, !last)
+		if err != nil {
+			return
+		}
+		if !last && len(resp) > 0 {
+			err = fmt.Errorf("card answered after %d of %d bytes", sent, len(capdu))
+			return
+		}
+		rapdu = resp
+	}
+
+	// an empty APDU asks the firmware for the next block of a chained response
+	for chained {
+		var resp []byte
+		resp, chained, err = r.exchangeBlock(ctx, nil, false)
+		if err != nil {
+			return
+		}
+		rapdu = append(rapdu, resp...)
+	}
+
+	return rapdu, nil
+}
+
+func (r *ISO14443AReader) APDU(ctx context.Context, capdu apdu.Capdu) (apdu.Rapdu, error) {
+	return rfid.ExchangerFunc(r.Exchange).APDU(ctx, capdu)
+}
+
+// RawOptions configures a raw frame, the zero value sends whole bytes as is to a selected card
+type RawOptions struct {
+	// AppendCRC has the firmware append the CRC_A
+	AppendCRC bool
+	// NoSelect powers the field before sending without selecting a card, for frames such as REQA and anticollision
+	NoSelect bool
+	// Bits is the number of bits to send for short frames, all of the bytes are sent if zero
+	Bits int
+	// Timeout is how long to wait for the card to answer, the firmware default if zero
+	Timeout time.Duration
+}
+
+// Raw sends a frame to the card and returns the response including its CRC, which is empty if the card did not answer.
+// The field is left on.
+func (r *ISO14443AReader) Raw(ctx context.Context, frame []byte, opts RawOptions) (_ []byte, err error) {
+	defer rfid.DeferWrap(ctx, &err)
+
+	err = checkDataLen(len(frame), MaxMixDataSize)
+	if err != nil {
+		return
+	}
+
+	flags := uint64(iso14aRaw | iso14aNoDisconnect)
+	if opts.AppendCRC {
+		flags |= iso14aAppendCRC
+	}
+	if opts.NoSelect {
+		flags |= iso14aConnect | iso14aNoSelect
+	}
+
+	var timeout uint64
+	if opts.Timeout > 0 {
+		flags |= iso14aSetTimeout
+		timeout = uint64(opts.Timeout.Milliseconds() * etusPerMillisecond)
+	}
+
+	resp, err := r.transceive(ctx, flags, uint64(len(frame))|uint64(opts.Bits)<<16, timeout, frame)
+	if err != nil {
+		return
+	}
+
+	respLen := int(resp.Args[0])
+	if respLen > len(resp.Data) {
+		err = fmt.Errorf("bad response length %d", respLen)
+		return
+	}
+	return resp.Data[:respLen], nil
+}
+
+// Close drops the field, the Client is not closed
+func (r *ISO14443AReader) Close() (err error) {
+	ctx := context.Background()
+	defer rfid.DeferWrap(ctx, &err)
+
+	r.identity = nil
+	return r.c.Send(ctx, Command{NG: true, Command: CmdHFDropField})
+}
@@ -0,0 +1,194 @@
+package pm3
+
+import (
+	"bytes"
+	"context"
+	"github.com/nvx/go-rfid/pm3/crc14a"
+	"github.com/nvx/go-rfid/type4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// cardSelect encodes iso14a_card_select_t
+func cardSelect(uid, atqa []byte, sak byte, ats []byte) []byte {
+	b := make([]byte, cardSelectLen)
+	copy(b, uid)
+	b[10] = byte(len(uid))
+	copy(b[11:13], atqa)
+	b[13] = sak
+	b[14] = byte(len(ats))
+	copy(b[15:], ats)
+	return b
+}
+
+func TestISO14443AReader(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	uid := []byte{0x04, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	// FSCI 0 limits frames to 16 bytes
+	ats := []byte{0x05, 0x70, 0x80, 0x70, 0x02}
+	rapdu := append(bytes.Repeat([]byte{0xAB}, 20), 0x90, 0x00)
+
+	var received []byte
+	blocks := 0
+	dropped := make(chan struct{})
+
+	// the firmware answers a select, a raw REQA and APDUs, chaining the response to the APDU
+	c := NewClient(fakeDevice(func(cmd Command) Response {
+		if cmd.Command == CmdHFDropField {
+			close(dropped)
+			return Response{}
+		}
+
+		args, data, err := splitArgs(cmd.Data)
+		if err != nil || cmd.Command != CmdHFISO14443AReader {
+			return Response{Status: StatusInvalidArg}
+		}
+
+		ack := func(arg0, arg1 uint64, data []byte) Response {
+			return Response{Command: CmdAck, Args: [3]uint64{arg0, arg1}, Data: data}
+		}
+
+		flags := args[0]
+		switch {
+		case flags&iso14aRaw != 0:
+			if flags&(iso14aConnect|iso14aNoSelect) != iso14aConnect|iso14aNoSelect || !bytes.Equal(data, []byte{0x26}) || args[1] != 1|7<<16 {
+				return ack(0, 0, nil)
+			}
+			return ack(2, 0, []byte{0x04, 0x00})
+		case flags&iso14aConnect != 0:
+			return ack(1, 0, cardSelect(uid, []byte{0x44, 0x00}, 0x20, crc14a.Append(ats)))
+		case flags&iso14aAPDU != 0:
+			blocks++
+			if len(data) > 0 {
+				received = append(received, data...)
+			}
+			switch {
+			case flags&iso14aSendChaining != 0:
+				return ack(2, 0, crc14a.Append(nil))
+			case len(data) > 0:
+				return ack(12, pcbChaining, crc14a.Append(rapdu[:10]))
+			default:
+				return ack(uint64(len(rapdu)-10+2), 0, crc14a.Append(rapdu[10:]))
+			}
+		default:
+			return Response{Status: StatusInvalidArg}
+		}
+	}), ClientOptions{})
+	defer c.Close()
+
+	r := NewISO14443AReader(c)
+
+	atqa, err := r.Raw(ctx, []byte{0x26}, RawOptions{NoSelect: true, Bits: 7})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x04, 0x00}, atqa)
+
+	identity, err := r.Connect(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &type4.Emulator{
+		UID:  uid,
+		SAK:  0x20,
+		ATQA: []byte{0x44, 0x00},
+		ATR:  []byte{0x3B, 0x80, 0x80, 0x01, 0x01},
+		ATS:  ats,
+	}, identity)
+
+	// 13 bytes fit in each block after the PCB and CRC
+	capdu := append([]byte{0x00, 0xD6, 0x00, 0x00, 0x1E}, bytes.Repeat([]byte{0xCD}, 30)...)
+	resp, err := r.Exchange(ctx, capdu)
+	require.NoError(t, err)
+	assert.Equal(t, rapdu, resp)
+	assert.Equal(t, capdu, received)
+	assert.Equal(t, 4, blocks)
+
+	require.NoError(t, r.Close())
+	select {
+	case <-dropped:
+	case <-ctx.Done():
+		t.Fatal("field not dropped")
+	}
+}
+
+func TestISO14443AReader_Connect_noATS(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := NewClient(fakeDevice(func(cmd Command) Response {
+		// a card that does not support ISO/IEC 14443-4 may be reported with an ATS of only its CRC and a TL of 0
+		return Response{Command: CmdAck, Args: [3]uint64{1}, Data: cardSelect([]byte{0x04, 0x11, 0x22, 0x33}, []byte{0x04, 0x00}, 0x08, crc14a.Append([]byte{0x00}))}
+	}), ClientOptions{})
+	defer c.Close()
+
+	r := NewISO14443AReader(c)
+	identity, err := r.Connect(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, identity.ATS)
+	assert.Empty(t, identity.ATR)
+	assert.Equal(t, byte(0x08), identity.SAK)
+}
+
+func TestISO14443AReader_Raw_oversize(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sent := false
+	c := NewClient(fakeDevice(func(cmd Command) Response {
+		sent = true
+		return Response{Command: CmdAck}
+	}), ClientOptions{})
+	defer c.Close()
+
+	r := NewISO14443AReader(c)
+	_, err := r.Raw(ctx, make([]byte, MaxMixDataSize+1), RawOptions{})
+	require.ErrorIs(t, err, ErrBadLength)
+	assert.False(t, sent)
+}
+
+func TestISO14443AReader_Exchange_errors(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name    string
+		respLen uint64
+		err     error
+	}{
+		{"no response", 0, ErrNoCardResponse},
+		{"CRC error", 0xFFFFFFFF, ErrCardCRC},
+		{"block type mismatch", 0xFFFFFFFE, ErrBlockMismatch},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			c := NewClient(fakeDevice(func(cmd Command) Response {
+				args, _, err := splitArgs(cmd.Data)
+				if err != nil || cmd.Command != CmdHFISO14443AReader {
+					return Response{}
+				}
+				if args[0]&iso14aAPDU != 0 {
+					return Response{Command: CmdAck, Args: [3]uint64{tt.respLen}}
+				}
+				return Response{Command: CmdAck, Args: [3]uint64{1}, Data: cardSelect([]byte{0x04, 0x11, 0x22, 0x33}, []byte{0x04, 0x00}, 0x20, crc14a.Append([]byte{0x05, 0x78, 0x80, 0x70, 0x02}))}
+			}), ClientOptions{})
+			defer c.Close()
+
+			r := NewISO14443AReader(c)
+			_, err := r.Connect(ctx)
+			require.NoError(t, err)
+
+			_, err = r.Exchange(ctx, []byte{0x00, 0xA4, 0x04, 0x00, 0x00})
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
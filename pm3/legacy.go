@@ -0,0 +1,180 @@
+package pm3
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-rfid"
+)
+
+const (
+	argsLen = 3 * 8
+
+	// oldFrameLen is the size of OLD commands and responses, the command, arguments and a full data block
+	oldFrameLen = 8 + argsLen + MaxDataSize
+
+	// MaxMixDataSize is the largest data of a MIX frame, which shares the data block with the arguments
+	MaxMixDataSize = MaxDataSize - argsLen
+)
+
+var ErrBadLength = errors.New("bad frame length")
+
+// Frame is a command in any of the layouts understood by the Proxmark3
+type Frame interface {
+	// CommandID is the command, responses are matched to requests on it
+	CommandID() CommandID
+	// Validate returns ErrBadLength if the data does not fit in the frame
+	Validate() error
+	// Bytes encodes the frame for USB, the frame must be valid
+	Bytes() []byte
+	// BytesCRC encodes the frame for links that require a CRC
+	BytesCRC() []byte
+}
+
+var (
+	_ Frame = Command{}
+	_ Frame = MixCommand{}
+	_ Frame = OldCommand{}
+)
+
+// MixCommand is a command with the NG preamble but the three arguments of OLD commands, as still used by commands
+// that have not moved to NG
+type MixCommand struct {
+	Command CommandID
+	Args    [3]uint64
+	Data    []byte
+}
+
+func (p MixCommand) CommandID() CommandID {
+	return p.Command
+}
+
+// NG returns the command in the layout it is sent with, the arguments prefixed to the data
+func (p MixCommand) NG() Command {
+	return Command{
+		Command: p.Command,
+		Data:    appendArgs(nil, p.Args, p.Data),
+	}
+}
+
+func (p MixCommand) Validate() error {
+	return checkDataLen(len(p.Data), MaxMixDataSize)
+}
+
+func (p MixCommand) Bytes() []byte {
+	return p.NG().Bytes()
+}
+
+func (p MixCommand) BytesCRC() []byte {
+	return p.NG().BytesCRC()
+}
+
+// OldCommand is a fixed size command used by firmware predating NG frames, it has no preamble or postamble
+type OldCommand struct {
+	Command CommandID
+	Args    [3]uint64
+	// Data is padded to MaxDataSize
+	Data []byte
+}
+
+func (p OldCommand) CommandID() CommandID {
+	return p.Command
+}
+
+func (p OldCommand) Validate() error {
+	return checkDataLen(len(p.Data), MaxDataSize)
+}
+
+func (p OldCommand) Bytes() []byte {
+	return encodeOld(uint64(p.Command), p.Args, p.Data)
+}
+
+// BytesCRC is the same as Bytes as OLD frames are never protected by a CRC
+func (p OldCommand) BytesCRC() []byte {
+	return p.Bytes()
+}
+
+// ParseCommand decodes a single command frame as a Command, MixCommand or OldCommand, frames of the OLD size without
+// the NG preamble are decoded as OLD commands. The postamble must be either the a3 magic or a correct CRC14A.
+func ParseCommand(b []byte) (_ Frame, err error) {
+	defer rfid.DeferWrap(context.Background(), &err)
+
+	hasPreamble := len(b) >= 4 && binary.LittleEndian.Uint32(b) == commandPreambleMagic
+	if !hasPreamble && len(b) == oldFrameLen {
+		cmd := OldCommand{Command: CommandID(binary.LittleEndian.Uint64(b))}
+		cmd.Args, cmd.Data, err = splitArgs(b[8:])
+		return cmd, err
+	}
+
+	if !hasPreamble {
+		err = ErrBadPreamble
+		return
+	}
+	if len(b) < commandPreambleLen+postambleLen {
+		err = fmt.Errorf("%w: command is %d bytes", ErrBadLength, len(b))
+		return
+	}
+
+	lenNg := binary.LittleEndian.Uint16(b[4:])
+	dataLen := int(lenNg & 0x7FFF)
+	if len(b) != commandPreambleLen+dataLen+postambleLen {
+		err = fmt.Errorf("%w: command is %d bytes with %d bytes of data", ErrBadLength, len(b), dataLen)
+		return
+	}
+
+	cmd := Command{
+		NG:      lenNg&(1<<15) != 0,
+		Command: CommandID(binary.LittleEndian.Uint16(b[6:])),
+		Data:    b[commandPreambleLen : commandPreambleLen+dataLen],
+	}
+
+	postamble := binary.LittleEndian.Uint16(b[len(b)-postambleLen:])
+	if postamble != commandPostambleMagic && postamble != postambleCRC(b[:len(b)-postambleLen]) {
+		err = fmt.Errorf("%w: %04X", ErrBadPostamble, postamble)
+		return
+	}
+
+	if cmd.NG {
+		return cmd, nil
+	}
+
+	mix := MixCommand{Command: cmd.Command}
+	mix.Args, mix.Data, err = splitArgs(cmd.Data)
+	return mix, err
+}
+
+func appendArgs(b []byte, args [3]uint64, data []byte) []byte {
+	for _, arg := range args {
+		b = binary.LittleEndian.AppendUint64(b, arg)
+	}
+	return append(b, data...)
+}
+
+func splitArgs(b []byte) (args [3]uint64, data []byte, err error) {
+	if len(b) < argsLen {
+		err = fmt.Errorf("%w: %d bytes is too short for arguments", ErrBadLength, len(b))
+		return
+	}
+
+	for i := range args {
+		args[i] = binary.LittleEndian.Uint64(b[i*8:])
+	}
+	return args, b[argsLen:], nil
+}
+
+// checkDataLen returns ErrBadLength if n bytes of data exceed limit
+func checkDataLen(n, limit int) error {
+	if n > limit {
+		return fmt.Errorf("%w: data is %d bytes, at most %d fit", ErrBadLength, n, limit)
+	}
+	return nil
+}
+
+// encodeOld encodes an OLD frame, data beyond MaxDataSize is truncated
+func encodeOld(cmd uint64, args [3]uint64, data []byte) []byte {
+	b := make([]byte, 0, oldFrameLen)
+	b = binary.LittleEndian.AppendUint64(b, cmd)
+	b = appendArgs(b, args, data[:min(len(data), MaxDataSize)])
+	return b[:oldFrameLen]
+}
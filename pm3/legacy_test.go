@@ -0,0 +1,180 @@
+package pm3
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMixCommand_Bytes(t *testing.T) {
+	t.Parallel()
+
+	cmd := MixCommand{Command: 0x0385, Args: [3]uint64{1, 0, 0}}
+	out := strings.ToUpper(hex.EncodeToString(cmd.Bytes()))
+	assert.Equal(t, "504D3361"+"1800"+"8503"+"0100000000000000"+strings.Repeat("00", 16)+"6133", out)
+}
+
+func TestFrame_Validate(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name  string
+		frame Frame
+		err   bool
+	}{
+		{"NG full", Command{NG: true, Data: make([]byte, MaxDataSize)}, false},
+		{"NG oversize", Command{NG: true, Data: make([]byte, MaxDataSize+1)}, true},
+		{"MIX full", MixCommand{Data: make([]byte, MaxMixDataSize)}, false},
+		// the arguments share the data block
+		{"MIX oversize", MixCommand{Data: make([]byte, MaxMixDataSize+1)}, true},
+		{"OLD full", OldCommand{Data: make([]byte, MaxDataSize)}, false},
+		{"OLD oversize", OldCommand{Data: make([]byte, MaxDataSize+1)}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tt.frame.Validate()
+			if tt.err {
+				require.ErrorIs(t, err, ErrBadLength)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestClient_Send_oversize(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// nothing reads the device end so any write would block
+	host, device := net.Pipe()
+	defer device.Close()
+	c := NewClient(host, ClientOptions{Old: true})
+	defer c.Close()
+
+	_, err := c.DoExpect(ctx, OldCommand{Command: CmdPing, Data: make([]byte, MaxDataSize+1)}, CmdAck)
+	require.ErrorIs(t, err, ErrBadLength)
+
+	err = c.Send(ctx, Command{NG: true, Command: CmdPing, Data: make([]byte, 0x8000)})
+	require.ErrorIs(t, err, ErrBadLength)
+}
+
+func TestParseCommand(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		cmd  Frame
+	}{
+		{"NG", CommandEnterStandalone},
+		{"MIX", MixCommand{Command: 0x0385, Args: [3]uint64{1, 2, 3}, Data: []byte{0x60, 0x00}}},
+		{"OLD", OldCommand{Command: CmdPing, Args: [3]uint64{4}, Data: make([]byte, MaxDataSize)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			for _, b := range [][]byte{tt.cmd.Bytes(), tt.cmd.BytesCRC()} {
+				cmd, err := ParseCommand(b)
+				require.NoError(t, err)
+				assert.Equal(t, tt.cmd, cmd)
+			}
+		})
+	}
+
+	b := CommandEnterStandalone.BytesCRC()
+	b[len(b)-1] ^= 0xFF
+	_, err := ParseCommand(b)
+	assert.ErrorIs(t, err, ErrBadPostamble)
+}
+
+func TestParseResponse_legacy(t *testing.T) {
+	t.Parallel()
+
+	mix := Response{Command: CmdAck, Args: [3]uint64{1, 2, 3}, Data: []byte{0xAA}, Postamble: responsePostambleMagic}
+	resp, err := ParseResponse(mix.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, mix, resp)
+
+	_, err = ParseResponse(Response{Command: CmdAck, Data: []byte{0xAA}, Postamble: responsePostambleMagic}.Bytes()[:14])
+	assert.Error(t, err)
+
+	old := Response{Old: true, Command: CmdAck, Args: [3]uint64{1}, Data: make([]byte, MaxDataSize)}
+	b := old.Bytes()
+	assert.Len(t, b, oldFrameLen)
+	resp, err = ParseResponse(b)
+	require.NoError(t, err)
+	assert.Equal(t, old, resp)
+}
+
+func TestClient_old(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	host, device := net.Pipe()
+	c := NewClient(host, ClientOptions{Old: true})
+	defer c.Close()
+
+	var mu sync.Mutex
+	var debug []Response
+	c.Handle(CmdDebugPrintString, func(resp Response) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		debug = append(debug, resp)
+	})
+
+	// the device prints a message then acknowledges each OLD command with its first argument, both in one write
+	go func() {
+		for {
+			b := make([]byte, oldFrameLen)
+			_, err := io.ReadFull(device, b)
+			if err != nil {
+				return
+			}
+			frame, err := ParseCommand(b)
+			if err != nil {
+				return
+			}
+			cmd, ok := frame.(OldCommand)
+			if !ok {
+				return
+			}
+
+			text := fmt.Sprintf("ping %d", cmd.Args[0])
+			out := Response{Old: true, Command: CmdDebugPrintString, Args: [3]uint64{uint64(len(text))}, Data: []byte(text)}.Bytes()
+			out = append(out, Response{Old: true, Command: CmdAck, Args: [3]uint64{cmd.Args[0]}, Data: []byte{byte(cmd.Args[0])}}.Bytes()...)
+			_, err = device.Write(out)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, arg := range []uint64{42, 43} {
+		resp, err := c.DoExpect(ctx, OldCommand{Command: CmdPing, Args: [3]uint64{arg}}, CmdAck)
+		require.NoError(t, err)
+		assert.True(t, resp.Old)
+		assert.Equal(t, arg, resp.Args[0])
+		assert.Equal(t, byte(arg), resp.Data[0])
+	}
+
+	// responses must not be overwritten by later reads
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, debug, 2)
+	assert.Equal(t, []byte("ping 42"), debug[0].Data[:debug[0].Args[0]])
+	assert.Equal(t, []byte("ping 43"), debug[1].Data[:debug[1].Args[0]])
+}
@@ -0,0 +1,324 @@
+// Package pm3test provides utilities for testing code talking to a Proxmark3 over unreliable links.
+package pm3test
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	ack = 0xFE
+
+	// DefaultStall is how long a FaultStall delays a read or write if FaultOptions.Stall is zero
+	DefaultStall = 50 * time.Millisecond
+)
+
+// Direction is the direction of an operation on a FaultyReadWriter
+type Direction uint8
+
+const (
+	Read Direction = iota
+	Write
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	default:
+		return fmt.Sprintf("Direction(%d)", uint8(d))
+	}
+}
+
+// Fault is a fault injected into a single read or write
+type Fault uint8
+
+const (
+	// FaultDrop discards all the data of the operation, a dropped write reports success
+	FaultDrop Fault = iota + 1
+	// FaultDropByte discards a single byte
+	FaultDropByte
+	// FaultCorrupt flips the bits of a single byte
+	FaultCorrupt
+	// FaultSplit delivers the data in two parts, the second with the next read or as a second write
+	FaultSplit
+	// FaultMerge holds read data back and delivers it together with the data of the following read, this delays it
+	// until more data arrives. It has no effect on writes.
+	FaultMerge
+	// FaultStall delays the operation
+	FaultStall
+	// FaultSpuriousAck inserts a 0xFE ACK byte before the data read. It has no effect on writes.
+	FaultSpuriousAck
+	// FaultEOF fails the operation with io.EOF without transferring any data
+	FaultEOF
+)
+
+func (f Fault) String() string {
+	switch f {
+	case FaultDrop:
+		return "drop"
+	case FaultDropByte:
+		return "drop byte"
+	case FaultCorrupt:
+		return "corrupt"
+	case FaultSplit:
+		return "split"
+	case FaultMerge:
+		return "merge"
+	case FaultStall:
+		return "stall"
+	case FaultSpuriousAck:
+		return "spurious ACK"
+	case FaultEOF:
+		return "EOF"
+	default:
+		return fmt.Sprintf("Fault(%d)", uint8(f))
+	}
+}
+
+// faults lists every Fault in the order rates are checked
+var faults = []Fault{FaultEOF, FaultStall, FaultDrop, FaultDropByte, FaultCorrupt, FaultSplit, FaultMerge, FaultSpuriousAck}
+
+// Rates are the probabilities of faults being injected into each operation, at most one random fault is injected per
+// operation
+type Rates map[Fault]float64
+
+// FaultOptions configures a FaultyReadWriter, the zero value injects no random faults
+type FaultOptions struct {
+	// Seed makes random faults deterministic for a given sequence of operations
+	Seed int64
+	// Read and Write are the rates of random faults per operation
+	Read  Rates
+	Write Rates
+	// Stall is how long FaultStall delays an operation, DefaultStall if zero
+	Stall time.Duration
+}
+
+// Injected records a fault that was injected
+type Injected struct {
+	Direction Direction
+	// N is the 1-based index of the operation in its direction
+	N     int
+	Fault Fault
+}
+
+func (i Injected) String() string {
+	return fmt.Sprintf("%s %s #%d", i.Fault, i.Direction, i.N)
+}
+
+type rule struct {
+	dir   Direction
+	n     int
+	fault Fault
+}
+
+// FaultyReadWriter wraps an io.ReadWriter injecting faults into reads and writes, either at random from a seed or
+// as scripted with On. Operations are numbered from 1 in each direction, with each Read and Write call to the
+// FaultyReadWriter counting as one operation. Usually each Write is one packet.
+type FaultyReadWriter struct {
+	rw   io.ReadWriter
+	opts FaultOptions
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	ops      [2]int
+	rules    []rule
+	injected []Injected
+
+	// readMu guards pending which holds read data that is yet to be returned, and readErr which is returned once
+	// pending has been read
+	readMu  sync.Mutex
+	pending []byte
+	readErr error
+}
+
+var _ io.ReadWriter = (*FaultyReadWriter)(nil)
+
+func NewFaultyReadWriter(rw io.ReadWriter, opts FaultOptions) *FaultyReadWriter {
+	if opts.Stall == 0 {
+		opts.Stall = DefaultStall
+	}
+
+	return &FaultyReadWriter{
+		rw:   rw,
+		opts: opts,
+		rand: rand.New(rand.NewSource(opts.Seed)),
+	}
+}
+
+// On injects fault into the nth operation in the given direction, for example On(Write, 3, FaultCorrupt) corrupts
+// the third packet written. Scripted faults replace random faults for that operation.
+func (f *FaultyReadWriter) On(dir Direction, n int, fault Fault) *FaultyReadWriter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rules = append(f.rules, rule{dir: dir, n: n, fault: fault})
+	return f
+}
+
+// Injected returns the faults injected so far
+func (f *FaultyReadWriter) Injected() []Injected {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Injected(nil), f.injected...)
+}
+
+// next numbers the next operation and picks its fault, zero if none. pos is a random value for choosing the byte to
+// corrupt, drop or split at.
+func (f *FaultyReadWriter) next(dir Direction) (fault Fault, pos int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.ops[dir]++
+	n := f.ops[dir]
+
+	for _, r := range f.rules {
+		if r.dir == dir && r.n == n {
+			fault = r.fault
+		}
+	}
+
+	rates := f.opts.Read
+	if dir == Write {
+		rates = f.opts.Write
+	}
+	// random values are drawn for every operation so scripted faults do not change later random faults
+	roll := f.rand.Float64()
+	pos = f.rand.Int()
+	if fault == 0 {
+		for _, candidate := range faults {
+			rate := rates[candidate]
+			if roll < rate {
+				fault = candidate
+				break
+			}
+			roll -= rate
+		}
+	}
+
+	if fault != 0 {
+		f.injected = append(f.injected, Injected{Direction: dir, N: n, Fault: fault})
+	}
+
+	return
+}
+
+func (f *FaultyReadWriter) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	f.readMu.Lock()
+	defer f.readMu.Unlock()
+
+	if len(f.pending) == 0 && f.readErr != nil {
+		err = f.readErr
+		f.readErr = nil
+		return 0, err
+	}
+
+	fault, pos := f.next(Read)
+
+	switch fault {
+	case FaultEOF:
+		return 0, io.EOF
+	case FaultStall:
+		time.Sleep(f.opts.Stall)
+	}
+
+	data := f.pending
+	f.pending = nil
+	if len(data) == 0 || fault == FaultMerge {
+		buf := make([]byte, len(p))
+		n, err = f.rw.Read(buf)
+		data = append(data, buf[:n]...)
+		if fault == FaultMerge && err == nil {
+			n, err = f.rw.Read(buf)
+			data = append(data, buf[:n]...)
+		}
+	}
+
+	switch fault {
+	case FaultDrop:
+		data = nil
+	case FaultDropByte:
+		if len(data) > 0 {
+			i := pos % len(data)
+			data = append(data[:i:i], data[i+1:]...)
+		}
+	case FaultCorrupt:
+		if len(data) > 0 {
+			data[pos%len(data)] ^= corruption(pos)
+		}
+	case FaultSplit:
+		if len(data) > 1 {
+			i := pos%(len(data)-1) + 1
+			f.pending = data[i:]
+			data = data[:i]
+		}
+	case FaultSpuriousAck:
+		data = append([]byte{ack}, data...)
+	}
+
+	n = copy(p, data)
+	if n < len(data) {
+		f.pending = append(data[n:], f.pending...)
+	}
+	if err != nil && len(f.pending) > 0 {
+		f.readErr = err
+		err = nil
+	}
+	return n, err
+}
+
+// corruption returns a non-zero value to XOR a byte with
+func corruption(pos int) byte {
+	return byte((pos>>8)%255 + 1)
+}
+
+func (f *FaultyReadWriter) Write(p []byte) (n int, err error) {
+	fault, pos := f.next(Write)
+
+	data := p
+	switch fault {
+	case FaultEOF:
+		return 0, io.EOF
+	case FaultStall:
+		time.Sleep(f.opts.Stall)
+	case FaultDrop:
+		return len(p), nil
+	case FaultDropByte:
+		if len(p) > 0 {
+			i := pos % len(p)
+			data = append(append([]byte(nil), p[:i]...), p[i+1:]...)
+		}
+	case FaultCorrupt:
+		if len(p) > 0 {
+			data = append([]byte(nil), p...)
+			data[pos%len(data)] ^= corruption(pos)
+		}
+	case FaultSplit:
+		if len(p) > 1 {
+			i := pos%(len(p)-1) + 1
+			n, err = f.rw.Write(p[:i])
+			if err != nil {
+				return
+			}
+			var m int
+			m, err = f.rw.Write(p[i:])
+			return n + m, err
+		}
+	}
+
+	_, err = f.rw.Write(data)
+	if err != nil {
+		return
+	}
+	return len(p), nil
+}
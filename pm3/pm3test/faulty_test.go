@@ -0,0 +1,157 @@
+package pm3test
+
+import (
+	"bytes"
+	"context"
+	"github.com/nvx/go-rfid/pm3/cardhopper"
+	"github.com/nvx/go-rfid/pm3/cardhopper/cardhoppertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+func TestFaultyReadWriter_On(t *testing.T) {
+	t.Parallel()
+
+	var written bytes.Buffer
+	f := NewFaultyReadWriter(readWriter{Reader: strings.NewReader("abcdef"), Writer: &written}, FaultOptions{}).
+		On(Write, 2, FaultDrop).
+		On(Write, 3, FaultCorrupt).
+		On(Read, 1, FaultSpuriousAck).
+		On(Read, 2, FaultEOF)
+
+	for _, s := range []string{"one", "two", "three", "four"} {
+		n, err := f.Write([]byte(s))
+		require.NoError(t, err)
+		assert.Equal(t, len(s), n)
+	}
+	assert.Len(t, written.String(), len("onethreefour"))
+	assert.True(t, strings.HasPrefix(written.String(), "one"))
+	assert.NotEqual(t, "onethreefour", written.String())
+	assert.True(t, strings.HasSuffix(written.String(), "four"))
+
+	buf := make([]byte, 3)
+	n, err := f.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{ack, 'a', 'b'}, buf[:n])
+
+	_, err = f.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+
+	b, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "cdef", string(b))
+
+	assert.Equal(t, []Injected{
+		{Direction: Write, N: 2, Fault: FaultDrop},
+		{Direction: Write, N: 3, Fault: FaultCorrupt},
+		{Direction: Read, N: 1, Fault: FaultSpuriousAck},
+		{Direction: Read, N: 2, Fault: FaultEOF},
+	}, f.Injected())
+}
+
+func TestFaultyReadWriter_seed(t *testing.T) {
+	t.Parallel()
+
+	run := func() (string, []Injected) {
+		var written bytes.Buffer
+		f := NewFaultyReadWriter(readWriter{Reader: strings.NewReader(""), Writer: &written}, FaultOptions{
+			Seed: 42,
+			Write: Rates{
+				FaultDropByte: 0.2,
+				FaultCorrupt:  0.2,
+				FaultSplit:    0.2,
+			},
+		})
+		for i := 0; i < 50; i++ {
+			_, err := f.Write([]byte("packet"))
+			require.NoError(t, err)
+		}
+		return written.String(), f.Injected()
+	}
+
+	written1, injected1 := run()
+	written2, injected2 := run()
+	assert.Equal(t, written1, written2)
+	assert.Equal(t, injected1, injected2)
+	assert.NotEmpty(t, injected1)
+}
+
+func TestFaultyReadWriter_cardHopper(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sim := cardhoppertest.New(cardhoppertest.Options{Script: []cardhoppertest.Step{
+		{Reader: []byte{0xE0, 0x80}, Want: []byte{0x05, 0x78, 0x80, 0x70, 0x02}},
+		{Reader: []byte{0xC2}, Want: []byte{0xC2}},
+	}})
+	defer sim.Close()
+
+	// write 1 is the standalone command, write 2 CARD and write 3 the tag type. Card mode is restarted and set up again
+	// after the ACK timeout.
+	f := NewFaultyReadWriter(sim, FaultOptions{
+		Seed: 1,
+		Read: Rates{FaultSplit: 0.5, FaultStall: 0.1},
+	}).On(Write, 3, FaultDrop)
+
+	e := cardhopper.NewWithOptions(f, cardhoppertest.TestCard(), cardhopper.Options{SetupOptions: cardhopper.SetupOptions{
+		StandaloneDelay: time.Millisecond,
+		AckTimeout:      100 * time.Millisecond,
+		RestartDelay:    time.Millisecond,
+	}})
+	require.NoError(t, e.Setup(ctx))
+
+	ectx, stop := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- e.Emulate(ectx)
+	}()
+
+	require.NoError(t, sim.Wait(ctx))
+	stop()
+	require.NoError(t, <-done)
+	assert.Contains(t, f.Injected(), Injected{Direction: Write, N: 3, Fault: FaultDrop})
+}
+
+func TestFaultyReadWriter_cardHopperLateAck(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sim := cardhoppertest.New(cardhoppertest.Options{Script: []cardhoppertest.Step{
+		{Reader: []byte{0xE0, 0x80}, Want: []byte{0x05, 0x78, 0x80, 0x70, 0x02}},
+	}})
+	defer sim.Close()
+
+	// read 2 is the ACK of the tag type, which arrives after the ACK timeout but before card mode is restarted
+	f := NewFaultyReadWriter(sim, FaultOptions{Stall: 300 * time.Millisecond}).On(Read, 2, FaultStall)
+
+	e := cardhopper.NewWithOptions(f, cardhoppertest.TestCard(), cardhopper.Options{SetupOptions: cardhopper.SetupOptions{
+		StandaloneDelay: time.Millisecond,
+		AckTimeout:      100 * time.Millisecond,
+		RestartDelay:    400 * time.Millisecond,
+	}})
+	require.NoError(t, e.Setup(ctx))
+
+	ectx, stop := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- e.Emulate(ectx)
+	}()
+
+	require.NoError(t, sim.Wait(ctx))
+	stop()
+	require.NoError(t, <-done)
+	assert.Equal(t, []Injected{{Direction: Read, N: 2, Fault: FaultStall}}, f.Injected())
+}
@@ -0,0 +1,369 @@
+package pm3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/nvx/go-rfid"
+	"io"
+)
+
+const (
+	responsePreambleMagic  = uint32(0x62334D50) // PM3b
+	responsePostambleMagic = uint16(0x3362)     // b3
+
+	// responsePreambleLen is the size of the magic, length, status, reason and command
+	responsePreambleLen = 4 + 2 + 2 + 1 + 2
+	postambleLen        = 2
+
+	// MaxDataSize is the largest payload of a frame
+	MaxDataSize = 512
+)
+
+var (
+	ErrBadPreamble  = errors.New("bad preamble")
+	ErrDataTooLong  = errors.New("data too long")
+	ErrBadPostamble = errors.New("bad postamble")
+)
+
+// Status is the status of a response, negative values are errors
+type Status int16
+
+const (
+	StatusSuccess         Status = 0
+	StatusUndefined       Status = -1
+	StatusInvalidArg      Status = -2
+	StatusDevNotSupported Status = -3
+	StatusTimeout         Status = -4
+	StatusAborted         Status = -5
+	StatusNotImplemented  Status = -6
+	StatusSoft            Status = -7
+	StatusFlash           Status = -8
+	StatusMalloc          Status = -9
+	StatusFile            Status = -10
+	StatusNoTTY           Status = -11
+	StatusInit            Status = -12
+	StatusWrongAnswer     Status = -13
+	StatusOutOfBounds     Status = -14
+	StatusCardExchange    Status = -15
+	StatusAPDUEncodeFail  Status = -16
+	StatusAPDUFail        Status = -17
+	StatusNoData          Status = -98
+	StatusFatal           Status = -99
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusSuccess:
+		return "success"
+	case StatusUndefined:
+		return "undefined error"
+	case StatusInvalidArg:
+		return "invalid argument"
+	case StatusDevNotSupported:
+		return "operation not supported by device"
+	case StatusTimeout:
+		return "timeout"
+	case StatusAborted:
+		return "operation aborted"
+	case StatusNotImplemented:
+		return "not implemented"
+	case StatusSoft:
+		return "soft error"
+	case StatusFlash:
+		return "flash error"
+	case StatusMalloc:
+		return "memory allocation error"
+	case StatusFile:
+		return "file error"
+	case StatusNoTTY:
+		return "no TTY"
+	case StatusInit:
+		return "initialization error"
+	case StatusWrongAnswer:
+		return "wrong answer"
+	case StatusOutOfBounds:
+		return "out of bounds"
+	case StatusCardExchange:
+		return "card exchange error"
+	case StatusAPDUEncodeFail:
+		return "APDU encode failed"
+	case StatusAPDUFail:
+		return "APDU failed"
+	case StatusNoData:
+		return "no data"
+	case StatusFatal:
+		return "fatal error"
+	default:
+		return fmt.Sprintf("Status(%d)", int16(s))
+	}
+}
+
+// StatusError is returned for responses with an error status
+type StatusError struct {
+	Command CommandID
+	Status  Status
+	Reason  int8
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("command %s failed: %s (reason %d)", e.Command, e.Status, e.Reason)
+}
+
+// Response is a frame sent by the Proxmark3
+type Response struct {
+	NG      bool
+	Status  Status
+	Reason  int8
+	Command CommandID
+	// Args are the arguments of MIX and OLD responses, which are not part of Data
+	Args [3]uint64
+	Data []byte
+	// Postamble is either the b3 magic or a CRC depending on the transport, OLD responses do not have one
+	Postamble uint16
+	// Old is set for responses in the OLD layout used by firmware predating NG frames
+	Old bool
+}
+
+// Err returns a *StatusError if the response status is an error
+func (r Response) Err() error {
+	if r.Status >= StatusSuccess {
+		return nil
+	}
+	return &StatusError{Command: r.Command, Status: r.Status, Reason: r.Reason}
+}
+
+// ValidPostamble reports if the postamble is the b3 magic or a correct CRC14A of the frame
+func (r Response) ValidPostamble() bool {
+	if r.Old || r.Postamble == responsePostambleMagic {
+		return true
+	}
+	b := r.Bytes()
+	return r.Postamble == postambleCRC(b[:len(b)-postambleLen])
+}
+
+// WithCRC returns the response with a CRC14A postamble
+func (r Response) WithCRC() Response {
+	if r.Old {
+		return r
+	}
+	b := r.Bytes()
+	r.Postamble = postambleCRC(b[:len(b)-postambleLen])
+	return r
+}
+
+func (r Response) Bytes() []byte {
+	if r.Old {
+		return encodeOld(uint64(r.Command), r.Args, r.Data)
+	}
+
+	buf := new(bytes.Buffer)
+
+	data := r.Data
+	if !r.NG {
+		data = appendArgs(nil, r.Args, r.Data)
+	}
+
+	lenNg := uint16(len(data) & 0x7FFF)
+	if r.NG {
+		lenNg |= 1 << 15
+	}
+
+	for _, v := range []any{responsePreambleMagic, lenNg, r.Status, r.Reason, r.Command} {
+		err := binary.Write(buf, binary.LittleEndian, v)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	_, err := buf.Write(data)
+	if err != nil {
+		panic(err)
+	}
+
+	err = binary.Write(buf, binary.LittleEndian, r.Postamble)
+	if err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
+
+// ParseResponse decodes a single response frame, frames of the OLD size without the NG preamble are decoded as OLD
+// responses
+func ParseResponse(b []byte) (_ Response, err error) {
+	defer rfid.DeferWrap(context.Background(), &err)
+
+	if !hasResponsePreamble(b) && len(b) == oldFrameLen {
+		return parseOldResponse(b)
+	}
+
+	resp, n, err := readResponse(bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	if n != len(b) {
+		err = fmt.Errorf("%d trailing bytes after response", len(b)-n)
+		return
+	}
+	return resp, nil
+}
+
+// ReadResponse reads a response frame from r, it does not resynchronise if the stream does not start with a frame
+func ReadResponse(r io.Reader) (_ Response, err error) {
+	defer rfid.DeferWrap(context.Background(), &err)
+
+	resp, _, err := readResponse(r)
+	return resp, err
+}
+
+func readResponse(r io.Reader) (resp Response, n int, err error) {
+	var preamble [responsePreambleLen]byte
+	read, err := io.ReadFull(r, preamble[:])
+	n += read
+	if err != nil {
+		return
+	}
+
+	if magic := binary.LittleEndian.Uint32(preamble[0:]); magic != responsePreambleMagic {
+		err = fmt.Errorf("%w: %08X", ErrBadPreamble, magic)
+		return
+	}
+
+	lenNg := binary.LittleEndian.Uint16(preamble[4:])
+	resp.NG = lenNg&(1<<15) != 0
+	dataLen := int(lenNg & 0x7FFF)
+	if dataLen > MaxDataSize {
+		err = fmt.Errorf("%w: %d", ErrDataTooLong, dataLen)
+		return
+	}
+	resp.Status = Status(binary.LittleEndian.Uint16(preamble[6:]))
+	resp.Reason = int8(preamble[8])
+	resp.Command = CommandID(binary.LittleEndian.Uint16(preamble[9:]))
+
+	buf := make([]byte, dataLen+postambleLen)
+	read, err = io.ReadFull(r, buf)
+	n += read
+	if err != nil {
+		err = noEOF(err)
+		return
+	}
+	resp.Data = buf[:dataLen]
+	resp.Postamble = binary.LittleEndian.Uint16(buf[dataLen:])
+
+	if !resp.NG {
+		resp.Args, resp.Data, err = splitArgs(resp.Data)
+		if err != nil {
+			return
+		}
+	}
+
+	return resp, n, nil
+}
+
+func hasResponsePreamble(b []byte) bool {
+	return len(b) >= 4 && binary.LittleEndian.Uint32(b) == responsePreambleMagic
+}
+
+func parseOldResponse(b []byte) (resp Response, err error) {
+	if len(b) != oldFrameLen {
+		err = fmt.Errorf("%w: OLD response is %d bytes", ErrBadLength, len(b))
+		return
+	}
+
+	resp.Old = true
+	resp.Command = CommandID(binary.LittleEndian.Uint64(b))
+	resp.Args, resp.Data, err = splitArgs(b[8:])
+	return
+}
+
+// noEOF converts io.EOF to io.ErrUnexpectedEOF for frames that have been started
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// nextResponse reads the next response from r, skipping anything before it unless old is set in which case anything
+// that is not an NG or MIX response is read as an OLD response. Partial frames are left unread so reads returning io.EOF
+// on timeouts can be retried.
+func nextResponse(r *bufio.Reader, old bool) (resp Response, skipped int, err error) {
+	if old {
+		var b []byte
+		b, err = r.Peek(4)
+		if err != nil {
+			return
+		}
+		if !hasResponsePreamble(b) {
+			b, err = r.Peek(oldFrameLen)
+			if err != nil {
+				return
+			}
+			// Data must not alias the buffer of r which is reused by later reads
+			resp, err = parseOldResponse(bytes.Clone(b))
+			if err != nil {
+				return
+			}
+			_, err = r.Discard(len(b))
+			return
+		}
+	}
+
+	skipped, err = syncPreamble(r)
+	if err != nil {
+		return
+	}
+
+	b, err := r.Peek(responsePreambleLen)
+	if err != nil {
+		return
+	}
+	dataLen := int(binary.LittleEndian.Uint16(b[4:]) & 0x7FFF)
+	if dataLen > MaxDataSize {
+		// skip the magic to resynchronise on the next frame
+		_, _ = r.Discard(1)
+		err = fmt.Errorf("%w: %d", ErrDataTooLong, dataLen)
+		return
+	}
+
+	b, err = r.Peek(responsePreambleLen + dataLen + postambleLen)
+	if err != nil {
+		return
+	}
+
+	_, err = r.Discard(len(b))
+	if err != nil {
+		return
+	}
+	resp, _, err = readResponse(bytes.NewReader(b))
+	return
+}
+
+// syncPreamble discards bytes until the start of a response, returning how many were discarded
+func syncPreamble(r *bufio.Reader) (skipped int, err error) {
+	var magic [4]byte
+	binary.LittleEndian.PutUint32(magic[:], responsePreambleMagic)
+
+	for {
+		var b []byte
+		b, err = r.Peek(len(magic))
+		if err != nil {
+			// discard a partial magic that can never match
+			if len(b) > 0 && !bytes.HasPrefix(magic[:], b) {
+				_, _ = r.Discard(1)
+				skipped++
+			}
+			return
+		}
+		if bytes.Equal(b, magic[:]) {
+			return
+		}
+
+		_, _ = r.Discard(1)
+		skipped++
+	}
+}
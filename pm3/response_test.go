@@ -0,0 +1,43 @@
+package pm3
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseResponse(t *testing.T) {
+	t.Parallel()
+
+	b, err := hex.DecodeString("504D3362" + "0380" + "FCFF" + "05" + "0901" + "010203" + "6233")
+	require.NoError(t, err)
+
+	resp, err := ParseResponse(b)
+	require.NoError(t, err)
+	assert.Equal(t, Response{
+		NG:        true,
+		Status:    StatusTimeout,
+		Reason:    5,
+		Command:   CmdPing,
+		Data:      []byte{0x01, 0x02, 0x03},
+		Postamble: responsePostambleMagic,
+	}, resp)
+	assert.Equal(t, b, resp.Bytes())
+
+	var statusErr *StatusError
+	require.ErrorAs(t, resp.Err(), &statusErr)
+	assert.Equal(t, StatusTimeout, statusErr.Status)
+
+	assert.True(t, resp.ValidPostamble())
+	resp.Postamble = 0x1234
+	assert.False(t, resp.ValidPostamble())
+	assert.True(t, resp.WithCRC().ValidPostamble())
+
+	_, err = ParseResponse(b[:len(b)-1])
+	assert.Error(t, err)
+
+	b[0] = 0x00
+	_, err = ParseResponse(b)
+	assert.ErrorIs(t, err, ErrBadPreamble)
+}
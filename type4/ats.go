@@ -0,0 +1,235 @@
+package type4
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	atsT0TAPresent = 0x10
+	atsT0TBPresent = 0x20
+	atsT0TCPresent = 0x40
+
+	atsTASameBitRate = 0x80
+
+	atsTCNADSupported = 0x01
+	atsTCCIDSupported = 0x02
+
+	// DefaultFWI is the FWI used when the ATS omits TB(1)
+	DefaultFWI = 4
+	// DefaultSFGI is the SFGI used when the ATS omits TB(1)
+	DefaultSFGI = 0
+	// DefaultFSCI is the FSCI used when the ATS omits T0
+	DefaultFSCI = 2
+)
+
+var (
+	ErrATSTooShort    = errors.New("ATS too short")
+	ErrATSBadTL       = errors.New("ATS TL does not match length")
+	ErrATSBadT0       = errors.New("ATS T0 has RFU bit set")
+	ErrATSBadFSCI     = errors.New("ATS FSCI out of range")
+	ErrATSBadTiming   = errors.New("ATS FWI or SFGI out of range")
+	ErrATSHistTooLong = errors.New("ATS historical bytes too long")
+	ErrATSNoT0        = errors.New("ATS without T0 must use the defaults")
+)
+
+// fscTable maps FSCI/FSDI to the frame size in bytes as per ISO/IEC 14443-4
+var fscTable = [...]int{16, 24, 32, 40, 48, 64, 96, 128, 256, 512, 1024, 2048, 4096}
+
+// FSC returns the frame size in bytes for the given FSCI (or FSDI), including the PCB and EDC.
+// Values outside the defined range are treated as the largest defined frame size as required by ISO/IEC 14443-4
+func FSC(fsci byte) int {
+	if int(fsci) >= len(fscTable) {
+		return fscTable[len(fscTable)-1]
+	}
+	return fscTable[fsci]
+}
+
+// ATS is a parsed ISO/IEC 14443-4 Answer To Select
+type ATS struct {
+	// NoT0 is set for an ATS of only the TL byte, every other field then has its default value
+	NoT0 bool
+
+	FSCI byte
+
+	// TA(1)
+	HasTA bool
+	// SameBitRate requires the same divisor to be used in both directions
+	SameBitRate bool
+	// DS is a bitmask of the supported PICC to PCD divisors: 0x01 = 2, 0x02 = 4, 0x04 = 8
+	DS byte
+	// DR is a bitmask of the supported PCD to PICC divisors: 0x01 = 2, 0x02 = 4, 0x04 = 8
+	DR byte
+
+	// TB(1)
+	HasTB bool
+	FWI   byte
+	SFGI  byte
+
+	// TC(1)
+	HasTC        bool
+	NADSupported bool
+	CIDSupported bool
+
+	Historical []byte
+}
+
+// ParseATS parses an ATS including the TL byte and excluding the CRC
+func ParseATS(b []byte) (ats ATS, err error) {
+	if len(b) < 1 {
+		err = ErrATSTooShort
+		return
+	}
+	if int(b[0]) != len(b) {
+		err = fmt.Errorf("%w: TL %d, length %d", ErrATSBadTL, b[0], len(b))
+		return
+	}
+
+	ats.FSCI = DefaultFSCI
+	ats.FWI = DefaultFWI
+	ats.SFGI = DefaultSFGI
+	ats.CIDSupported = true
+
+	if len(b) == 1 {
+		ats.NoT0 = true
+		return
+	}
+
+	t0 := b[1]
+	if t0&0x80 != 0 {
+		err = ErrATSBadT0
+		return
+	}
+	ats.FSCI = t0 & 0x0F
+
+	rest := b[2:]
+	next := func() (byte, error) {
+		if len(rest) == 0 {
+			return 0, ErrATSTooShort
+		}
+		v := rest[0]
+		rest = rest[1:]
+		return v, nil
+	}
+
+	if t0&atsT0TAPresent != 0 {
+		var ta byte
+		ta, err = next()
+		if err != nil {
+			return
+		}
+		ats.HasTA = true
+		ats.SameBitRate = ta&atsTASameBitRate != 0
+		ats.DS = ta >> 4 & 0x07
+		ats.DR = ta & 0x07
+	}
+
+	if t0&atsT0TBPresent != 0 {
+		var tb byte
+		tb, err = next()
+		if err != nil {
+			return
+		}
+		ats.HasTB = true
+		ats.FWI = tb >> 4
+		ats.SFGI = tb & 0x0F
+	}
+
+	if t0&atsT0TCPresent != 0 {
+		var tc byte
+		tc, err = next()
+		if err != nil {
+			return
+		}
+		ats.HasTC = true
+		ats.NADSupported = tc&atsTCNADSupported != 0
+		ats.CIDSupported = tc&atsTCCIDSupported != 0
+	}
+
+	if len(rest) > 0 {
+		ats.Historical = append([]byte(nil), rest...)
+	}
+
+	return
+}
+
+// Bytes encodes the ATS including the TL byte and excluding the CRC
+func (a ATS) Bytes() (_ []byte, err error) {
+	if a.NoT0 {
+		if a.HasTA || a.HasTB || a.HasTC || len(a.Historical) > 0 || a.FSCI != DefaultFSCI || a.FWI != DefaultFWI ||
+			a.SFGI != DefaultSFGI || !a.CIDSupported {
+			err = ErrATSNoT0
+			return
+		}
+		return []byte{0x01}, nil
+	}
+
+	if a.FSCI > 0x0F {
+		err = ErrATSBadFSCI
+		return
+	}
+	if a.FWI > 0x0F || a.SFGI > 0x0F {
+		err = ErrATSBadTiming
+		return
+	}
+
+	t0 := a.FSCI
+	out := []byte{0, 0}
+	if a.HasTA {
+		t0 |= atsT0TAPresent
+		ta := (a.DS&0x07)<<4 | a.DR&0x07
+		if a.SameBitRate {
+			ta |= atsTASameBitRate
+		}
+		out = append(out, ta)
+	}
+	if a.HasTB {
+		t0 |= atsT0TBPresent
+		out = append(out, a.FWI<<4|a.SFGI)
+	}
+	if a.HasTC {
+		t0 |= atsT0TCPresent
+		var tc byte
+		if a.NADSupported {
+			tc |= atsTCNADSupported
+		}
+		if a.CIDSupported {
+			tc |= atsTCCIDSupported
+		}
+		out = append(out, tc)
+	}
+	out = append(out, a.Historical...)
+
+	if len(out) > 0xFF {
+		err = ErrATSHistTooLong
+		return
+	}
+
+	out[0] = byte(len(out))
+	out[1] = t0
+	return out, nil
+}
+
+// FSC returns the maximum frame size the PICC is able to receive
+func (a ATS) FSC() int {
+	return FSC(a.FSCI)
+}
+
+// PCSCATR returns the ATR a PC/SC reader synthesises for an ISO/IEC 14443-4 Type A card from its historical bytes.
+// PC/SC limits the ATR to 15 historical bytes so any beyond that are dropped
+func (a ATS) PCSCATR() []byte {
+	hist := a.Historical
+	if len(hist) > 15 {
+		hist = hist[:15]
+	}
+
+	atr := append([]byte{0x3B, 0x80 | byte(len(hist)), 0x80, 0x01}, hist...)
+
+	// TCK is the XOR of every byte from T0 onwards
+	var tck byte
+	for _, b := range atr[1:] {
+		tck ^= b
+	}
+
+	return append(atr, tck)
+}
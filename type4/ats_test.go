@@ -0,0 +1,97 @@
+package type4
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseATS(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		in      []byte
+		want    ATS
+		wantErr error
+	}{
+		{
+			name: "TL only",
+			in:   []byte{0x01},
+			want: ATS{NoT0: true, FSCI: DefaultFSCI, FWI: DefaultFWI, SFGI: DefaultSFGI, CIDSupported: true},
+		},
+		{
+			name: "all interface bytes",
+			in:   []byte{0x06, 0x75, 0x77, 0x81, 0x02, 0x80},
+			want: ATS{
+				FSCI:         5,
+				HasTA:        true,
+				DS:           0x07,
+				DR:           0x07,
+				HasTB:        true,
+				FWI:          8,
+				SFGI:         1,
+				HasTC:        true,
+				CIDSupported: true,
+				Historical:   []byte{0x80},
+			},
+		},
+		{
+			name: "TB only",
+			in:   []byte{0x03, 0x28, 0xE1},
+			want: ATS{FSCI: 8, HasTB: true, FWI: 0x0E, SFGI: 0x01, CIDSupported: true},
+		},
+		{
+			name:    "bad TL",
+			in:      []byte{0x05, 0x78},
+			wantErr: ErrATSBadTL,
+		},
+		{
+			name:    "missing TC",
+			in:      []byte{0x03, 0x70, 0x00},
+			wantErr: ErrATSTooShort,
+		},
+		{
+			name:    "RFU T0 bit",
+			in:      []byte{0x02, 0x80},
+			wantErr: ErrATSBadT0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := ParseATS(tt.in)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+
+			b, err := got.Bytes()
+			require.NoError(t, err)
+			assert.Equal(t, tt.in, b)
+		})
+	}
+}
+
+func TestATS_Bytes_noT0(t *testing.T) {
+	t.Parallel()
+
+	ats, err := ParseATS([]byte{0x01})
+	require.NoError(t, err)
+
+	ats.HasTB = true
+	_, err = ats.Bytes()
+	assert.ErrorIs(t, err, ErrATSNoT0)
+}
+
+func TestATS_PCSCATR(t *testing.T) {
+	t.Parallel()
+
+	ats, err := ParseATS([]byte{0x06, 0x75, 0x77, 0x81, 0x02, 0x80})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x3B, 0x81, 0x80, 0x01, 0x80, 0x80}, ats.PCSCATR())
+}
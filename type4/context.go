@@ -0,0 +1,19 @@
+package type4
+
+import (
+	"context"
+)
+
+type nadKey struct{}
+
+// WithNAD returns a context carrying the ISO/IEC 14443-4 node address the command APDU was sent with
+func WithNAD(ctx context.Context, nad byte) context.Context {
+	return context.WithValue(ctx, nadKey{}, nad)
+}
+
+// NADFromContext returns the node address the command APDU was sent with, if any.
+// The high nibble is the destination node address and the low nibble the source node address.
+func NADFromContext(ctx context.Context) (nad byte, ok bool) {
+	nad, ok = ctx.Value(nadKey{}).(byte)
+	return
+}
@@ -0,0 +1,73 @@
+package type4
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const (
+	sakCascade  = 0x04
+	sakISO14443 = 0x20
+
+	// maxFSCI is the largest FSCI defined by ISO/IEC 14443-4, higher values are RFU
+	maxFSCI = 0x0C
+)
+
+// Validate checks the identity parameters of the Emulator are consistent with each other.
+// ATQA is expected in transmission order (LSB first) and ATS including the TL byte.
+// All problems found are returned joined together
+func (t *Emulator) Validate() error {
+	var errs []error
+
+	switch len(t.UID) {
+	case 4, 7, 10:
+	default:
+		errs = append(errs, fmt.Errorf("UID length %d is not 4, 7 or 10", len(t.UID)))
+	}
+
+	if len(t.ATQA) != 2 {
+		errs = append(errs, fmt.Errorf("ATQA length %d is not 2", len(t.ATQA)))
+	} else {
+		uidSize := t.ATQA[0] >> 6
+		if uidSize == 3 {
+			errs = append(errs, fmt.Errorf("ATQA %X has RFU UID size", t.ATQA))
+		} else if want := []int{4, 7, 10}[uidSize]; want != len(t.UID) {
+			errs = append(errs, fmt.Errorf("ATQA %X indicates %d byte UID but UID is %d bytes", t.ATQA, want, len(t.UID)))
+		}
+
+		// Exactly one bit frame anticollision bit must be set for a card that answers anticollision with a SAK
+		anticol := t.ATQA[0] & 0x1F
+		if anticol == 0 || anticol&(anticol-1) != 0 {
+			errs = append(errs, fmt.Errorf("ATQA %X bit frame anticollision is not compatible with a SAK", t.ATQA))
+		}
+	}
+
+	if t.SAK&sakISO14443 == 0 {
+		errs = append(errs, fmt.Errorf("SAK %02X does not indicate ISO/IEC 14443-4 support", t.SAK))
+	}
+	if t.SAK&sakCascade != 0 {
+		errs = append(errs, fmt.Errorf("SAK %02X has the cascade bit set", t.SAK))
+	}
+
+	ats, err := ParseATS(t.ATS)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid ATS %X: %w", t.ATS, err))
+	} else {
+		if ats.FSCI > maxFSCI {
+			errs = append(errs, fmt.Errorf("ATS FSCI %X is RFU", ats.FSCI))
+		}
+
+		if len(t.ATR) > 0 {
+			if want := ats.PCSCATR(); !bytes.Equal(want, t.ATR) {
+				errs = append(errs, fmt.Errorf("ATR %X does not match %X derived from ATS historical bytes", t.ATR, want))
+			}
+		}
+	}
+
+	if t.Handler == nil {
+		errs = append(errs, errors.New("no Handler"))
+	}
+
+	return errors.Join(errs...)
+}
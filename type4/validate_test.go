@@ -0,0 +1,125 @@
+package type4
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type nopHandler struct{}
+
+func (nopHandler) Exchange(context.Context, []byte) ([]byte, error) {
+	return []byte{0x90, 0x00}, nil
+}
+
+func (nopHandler) Reset(context.Context) {}
+
+func validEmulator() *Emulator {
+	return &Emulator{
+		UID:     []byte{0x04, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66},
+		SAK:     0x20,
+		ATQA:    []byte{0x44, 0x00},
+		ATS:     []byte{0x05, 0x78, 0x80, 0x70, 0x02},
+		Handler: nopHandler{},
+	}
+}
+
+func TestEmulator_Validate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		modify func(e *Emulator)
+		want   []string
+	}{
+		{
+			name:   "valid",
+			modify: func(e *Emulator) {},
+		},
+		{
+			name:   "valid with ATR",
+			modify: func(e *Emulator) { e.ATR = []byte{0x3B, 0x80, 0x80, 0x01, 0x01} },
+		},
+		{
+			name:   "UID length",
+			modify: func(e *Emulator) { e.UID = e.UID[:5] },
+			want:   []string{"UID length 5 is not 4, 7 or 10", "indicates 7 byte UID but UID is 5 bytes"},
+		},
+		{
+			name:   "ATQA length",
+			modify: func(e *Emulator) { e.ATQA = []byte{0x44} },
+			want:   []string{"ATQA length 1 is not 2"},
+		},
+		{
+			name:   "ATQA RFU UID size",
+			modify: func(e *Emulator) { e.ATQA = []byte{0xC4, 0x00} },
+			want:   []string{"has RFU UID size"},
+		},
+		{
+			name:   "ATQA UID size mismatch",
+			modify: func(e *Emulator) { e.ATQA = []byte{0x04, 0x00} },
+			want:   []string{"indicates 4 byte UID but UID is 7 bytes"},
+		},
+		{
+			name:   "ATQA anticollision",
+			modify: func(e *Emulator) { e.ATQA = []byte{0x46, 0x00} },
+			want:   []string{"bit frame anticollision is not compatible with a SAK"},
+		},
+		{
+			name:   "SAK without ISO/IEC 14443-4",
+			modify: func(e *Emulator) { e.SAK = 0x08 },
+			want:   []string{"does not indicate ISO/IEC 14443-4 support"},
+		},
+		{
+			name:   "SAK cascade",
+			modify: func(e *Emulator) { e.SAK = 0x24 },
+			want:   []string{"has the cascade bit set"},
+		},
+		{
+			name:   "invalid ATS",
+			modify: func(e *Emulator) { e.ATS = []byte{0x05, 0x78} },
+			want:   []string{"invalid ATS"},
+		},
+		{
+			name:   "ATS FSCI RFU",
+			modify: func(e *Emulator) { e.ATS = []byte{0x05, 0x7D, 0x80, 0x70, 0x02} },
+			want:   []string{"ATS FSCI D is RFU"},
+		},
+		{
+			name:   "ATR mismatch",
+			modify: func(e *Emulator) { e.ATR = []byte{0x3B, 0x00} },
+			want:   []string{"does not match 3B80800101 derived from ATS historical bytes"},
+		},
+		{
+			name:   "no Handler",
+			modify: func(e *Emulator) { e.Handler = nil },
+			want:   []string{"no Handler"},
+		},
+		{
+			name: "all problems joined",
+			modify: func(e *Emulator) {
+				e.SAK = 0x04
+				e.Handler = nil
+			},
+			want: []string{"does not indicate ISO/IEC 14443-4 support", "has the cascade bit set", "no Handler"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			e := validEmulator()
+			tt.modify(e)
+
+			err := e.Validate()
+			if len(tt.want) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			for _, want := range tt.want {
+				assert.ErrorContains(t, err, want)
+			}
+		})
+	}
+}